@@ -0,0 +1,252 @@
+package checker
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+)
+
+const (
+	ReadYourWrites    = "read-your-writes"
+	MonotonicReads    = "monotonic-reads"
+	WritesFollowReads = "writes-follow-reads"
+	MonotonicWrites   = "monotonic-writes"
+	Causal            = "causal"
+)
+
+// Event is one completed operation of a session. VersionVector is the vector
+// the server returned with its reply: the server's clock for a read and the
+// operation's own vector for a write. An indeterminate write timed out or was
+// cancelled before its reply arrived, so it may or may not have taken effect,
+// and it has no version vector. Guarantees names the guarantees the session
+// asked for, and only those are checked; a causal session lists Causal along
+// with the four session guarantees.
+type Event struct {
+	Client        uint64
+	Index         uint64
+	OperationType uint64
+	Key           []byte
+	Value         []byte
+	VersionVector []uint64
+	Server        uint64
+	Guarantees    []string
+	Indeterminate bool `json:",omitempty"`
+}
+
+type Violation struct {
+	Guarantee string
+	Earlier   Event
+	Later     Event
+	Reason    string
+}
+
+func (v Violation) String() string {
+	return fmt.Sprintf("%s: client %d operation %d at server %d %v does not follow operation %d at server %d %v: %s",
+		v.Guarantee, v.Later.Client, v.Later.Index, v.Later.Server, v.Later.VersionVector,
+		v.Earlier.Index, v.Earlier.Server, v.Earlier.VersionVector, v.Reason)
+}
+
+func WriteHistory(w io.Writer, history []Event) error {
+	enc := json.NewEncoder(w)
+	for i := range history {
+		err := enc.Encode(&history[i])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func ReadHistory(r io.Reader) ([]Event, error) {
+	history := make([]Event, 0)
+	dec := json.NewDecoder(bufio.NewReader(r))
+	for {
+		e := Event{}
+		err := dec.Decode(&e)
+		if err == io.EOF {
+			return history, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		history = append(history, e)
+	}
+}
+
+func dominates(v1 []uint64, v2 []uint64) bool {
+	if len(v1) != len(v2) {
+		return false
+	}
+	for i := range v1 {
+		if v1[i] < v2[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func lexicographicLess(v1 []uint64, v2 []uint64) bool {
+	for i := range v1 {
+		if v1[i] != v2[i] {
+			return v1[i] < v2[i]
+		}
+	}
+	return false
+}
+
+func maxVector(v1 []uint64, v2 []uint64) []uint64 {
+	if v1 == nil {
+		return append([]uint64(nil), v2...)
+	}
+	out := append([]uint64(nil), v1...)
+	for i := range out {
+		if i < len(v2) && v2[i] > out[i] {
+			out[i] = v2[i]
+		}
+	}
+	return out
+}
+
+// The running maximum is only a witness that some earlier operation was not
+// observed; the violation reports the latest earlier operation that the later
+// one fails to dominate.
+func findEarlier(session []Event, upto int, operationType uint64, later Event) Event {
+	for i := upto - 1; i >= 0; i-- {
+		if session[i].OperationType == operationType && !dominates(later.VersionVector, session[i].VersionVector) {
+			return session[i]
+		}
+	}
+	return Event{}
+}
+
+func checkSession(session []Event) []Violation {
+	violations := make([]Violation, 0)
+	var reads []uint64
+	var writes []uint64
+
+	for i, e := range session {
+		if e.Indeterminate {
+			continue
+		}
+		if e.OperationType == 0 {
+			if reads != nil && !dominates(e.VersionVector, reads) {
+				violations = append(violations, Violation{Guarantee: MonotonicReads, Earlier: findEarlier(session, i, 0, e), Later: e,
+					Reason: "read does not reflect an earlier read"})
+			}
+			if writes != nil && !dominates(e.VersionVector, writes) {
+				violations = append(violations, Violation{Guarantee: ReadYourWrites, Earlier: findEarlier(session, i, 1, e), Later: e,
+					Reason: "read does not reflect an earlier write"})
+			}
+			reads = maxVector(reads, e.VersionVector)
+		} else {
+			if reads != nil && !dominates(e.VersionVector, reads) {
+				violations = append(violations, Violation{Guarantee: WritesFollowReads, Earlier: findEarlier(session, i, 0, e), Later: e,
+					Reason: "write is not ordered after an earlier read"})
+			}
+			if writes != nil && !dominates(e.VersionVector, writes) {
+				violations = append(violations, Violation{Guarantee: MonotonicWrites, Earlier: findEarlier(session, i, 1, e), Later: e,
+					Reason: "write is not ordered after an earlier write"})
+			}
+			writes = maxVector(writes, e.VersionVector)
+		}
+	}
+
+	return violations
+}
+
+// A read must return the value of the write that is last, in lexicographic
+// version vector order, among the writes to its key that its version vector
+// covers. Writes are sorted in that order, so the search walks back from the
+// read's own position until it finds a covered write. The order of an
+// indeterminate write is unknown, so a read may return its value instead.
+func checkReadsFrom(history []Event) []Violation {
+	violations := make([]Violation, 0)
+	writes := make(map[string][]Event)
+	indeterminate := make(map[[2]string]bool)
+	for _, e := range history {
+		if e.OperationType == 1 && e.Indeterminate {
+			indeterminate[[2]string{string(e.Key), string(e.Value)}] = true
+		} else if e.OperationType == 1 {
+			writes[string(e.Key)] = append(writes[string(e.Key)], e)
+		}
+	}
+	for _, w := range writes {
+		sort.Slice(w, func(i, j int) bool { return lexicographicLess(w[i].VersionVector, w[j].VersionVector) })
+	}
+
+	for _, e := range history {
+		if e.OperationType != 0 {
+			continue
+		}
+		w := writes[string(e.Key)]
+		i := sort.Search(len(w), func(i int) bool { return lexicographicLess(e.VersionVector, w[i].VersionVector) })
+		expected := Event{}
+		found := false
+		for i--; i >= 0; i-- {
+			if dominates(e.VersionVector, w[i].VersionVector) {
+				expected = w[i]
+				found = true
+				break
+			}
+		}
+
+		if indeterminate[[2]string{string(e.Key), string(e.Value)}] {
+			continue
+		}
+		if found && !bytes.Equal(expected.Value, e.Value) {
+			violations = append(violations, Violation{Guarantee: Causal, Earlier: expected, Later: e,
+				Reason: fmt.Sprintf("read returned %x instead of the latest covered write %x", e.Value, expected.Value)})
+		} else if !found && len(e.Value) != 0 {
+			violations = append(violations, Violation{Guarantee: Causal, Later: e,
+				Reason: fmt.Sprintf("read returned %x but no covered write to the key was recorded", e.Value)})
+		}
+	}
+
+	return violations
+}
+
+func asked(e Event, guarantee string) bool {
+	for _, g := range e.Guarantees {
+		if g == guarantee {
+			return true
+		}
+	}
+	return false
+}
+
+// Check validates every session in the history against the session
+// guarantees it asked for, and the reads of causal sessions against causal
+// consistency.
+func Check(history []Event) []Violation {
+	sessions := make(map[uint64][]Event)
+	clients := make([]uint64, 0)
+	for _, e := range history {
+		_, ok := sessions[e.Client]
+		if !ok {
+			clients = append(clients, e.Client)
+		}
+		sessions[e.Client] = append(sessions[e.Client], e)
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i] < clients[j] })
+
+	violations := make([]Violation, 0)
+	for _, c := range clients {
+		session := sessions[c]
+		sort.SliceStable(session, func(i, j int) bool { return session[i].Index < session[j].Index })
+		for _, v := range checkSession(session) {
+			if asked(v.Later, v.Guarantee) {
+				violations = append(violations, v)
+			}
+		}
+	}
+
+	for _, v := range checkReadsFrom(history) {
+		if asked(v.Later, Causal) {
+			violations = append(violations, v)
+		}
+	}
+	return violations
+}
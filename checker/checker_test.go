@@ -0,0 +1,122 @@
+package checker
+
+import (
+	"testing"
+)
+
+var causal = []string{ReadYourWrites, MonotonicReads, WritesFollowReads, MonotonicWrites, Causal}
+
+func write(client uint64, index uint64, key string, value string, vv ...uint64) Event {
+	return Event{Client: client, Index: index, OperationType: 1, Key: []byte(key), Value: []byte(value), VersionVector: vv,
+		Guarantees: causal}
+}
+
+func read(client uint64, index uint64, key string, value string, vv ...uint64) Event {
+	e := Event{Client: client, Index: index, OperationType: 0, Key: []byte(key), VersionVector: vv, Guarantees: causal}
+	if value != "" {
+		e.Value = []byte(value)
+	}
+	return e
+}
+
+func guarantees(violations []Violation) map[string]uint64 {
+	count := make(map[string]uint64)
+	for _, v := range violations {
+		count[v.Guarantee]++
+	}
+	return count
+}
+
+func TestCheckAcceptsCausalHistory(t *testing.T) {
+	history := []Event{
+		write(1, 0, "a", "x", 1, 0),
+		read(1, 1, "a", "x", 1, 0),
+		read(2, 0, "a", "", 0, 0),
+		read(2, 1, "a", "x", 1, 1),
+		write(2, 2, "a", "y", 1, 2),
+		read(1, 2, "a", "y", 1, 2),
+	}
+	for _, v := range Check(history) {
+		t.Error(v)
+	}
+}
+
+func TestCheckFindsReadYourWritesViolation(t *testing.T) {
+	history := []Event{
+		write(1, 0, "a", "x", 1, 0),
+		read(1, 1, "a", "", 0, 0),
+	}
+	violations := Check(history)
+	count := guarantees(violations)
+	if count[ReadYourWrites] != 1 || count[MonotonicReads] != 0 {
+		t.Fatalf("got violations %v", violations)
+	}
+	if violations[0].Earlier.Index != 0 || violations[0].Later.Index != 1 {
+		t.Fatalf("violation reports operations %d and %d", violations[0].Earlier.Index, violations[0].Later.Index)
+	}
+}
+
+func TestCheckFindsMonotonicReadsViolation(t *testing.T) {
+	history := []Event{
+		write(1, 0, "a", "x", 1, 0),
+		read(2, 0, "a", "x", 1, 0),
+		read(2, 1, "a", "", 0, 0),
+	}
+	count := guarantees(Check(history))
+	if count[MonotonicReads] != 1 || count[ReadYourWrites] != 0 {
+		t.Fatalf("got violations %v", count)
+	}
+	if count[Causal] != 0 {
+		t.Fatalf("a session violation is also reported as a causal one: %v", count)
+	}
+}
+
+// Only the guarantees a session asked for are checked.
+func TestCheckOnlyChecksRequestedGuarantees(t *testing.T) {
+	history := []Event{
+		write(1, 0, "a", "x", 1, 0),
+		read(1, 1, "a", "", 0, 0),
+		read(1, 2, "a", "y", 1, 1),
+		read(1, 3, "a", "", 0, 0),
+	}
+	for _, requested := range [][]string{nil, {MonotonicReads}} {
+		for i := range history {
+			history[i].Guarantees = requested
+		}
+		count := guarantees(Check(history))
+		if count[MonotonicReads] != uint64(len(requested)) || count[ReadYourWrites] != 0 || count[Causal] != 0 {
+			t.Fatalf("session asking for %v got violations %v", requested, count)
+		}
+	}
+}
+
+func TestCheckFindsStaleRead(t *testing.T) {
+	history := []Event{
+		write(1, 0, "a", "x", 1, 0),
+		write(2, 0, "a", "y", 1, 1),
+		read(3, 0, "a", "x", 1, 1),
+	}
+	count := guarantees(Check(history))
+	if count[Causal] != 1 {
+		t.Fatalf("got violations %v", count)
+	}
+}
+
+func TestCheckAcceptsIndeterminateWrites(t *testing.T) {
+	history := []Event{
+		write(1, 0, "a", "x", 1, 0),
+		{Client: 1, Index: 1, OperationType: 1, Key: []byte("a"), Value: []byte("y"), Guarantees: causal, Indeterminate: true},
+		read(1, 2, "a", "y", 2, 0),
+		read(2, 0, "a", "x", 1, 0),
+		read(2, 1, "a", "y", 2, 0),
+	}
+	for _, v := range Check(history) {
+		t.Error(v)
+	}
+
+	history = append(history, read(2, 2, "a", "z", 2, 0))
+	count := guarantees(Check(history))
+	if count[Causal] != 1 {
+		t.Fatalf("a read of a value nobody wrote is not flagged: %v", count)
+	}
+}
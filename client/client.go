@@ -1,20 +1,25 @@
 package client
 
 import (
-	"encoding/gob"
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"math/rand/v2"
-	"net"
+	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/alanwang67/session_semantics/checker"
 	"github.com/alanwang67/session_semantics/protocol"
 	"github.com/alanwang67/session_semantics/server"
 )
 
 type ConfigurationInfo struct {
 	Threads                 uint64
-	SessionSemantic         uint64
+	Guarantees              Guarantee
 	Time                    uint64
 	SwitchServer            uint64
 	Workload                uint64
@@ -22,58 +27,111 @@ type ConfigurationInfo struct {
 	PrimaryBackupRandom     bool
 	GossipRandom            bool
 	PinnedRoundRobin        bool
+	HistoryFile             string
+	ResultsFile             string
+	SampleInterval          uint64
+	Keys                    KeyDistribution
+	Profile                 WorkloadProfile
+	Timeout                 uint64
+	FailoverWait            uint64
+	Reject                  bool
 }
 
 type NClient struct {
 	Id                 uint64
-	ServerDecoders     []*gob.Decoder
-	ServerEncoder      []*gob.Encoder
+	ServerConnections  []server.Conn
 	WriteVersionVector []uint64
 	ReadVersionVector  []uint64
-	SessionSemantic    uint64
+	Guarantees         Guarantee
+	RequestId          uint64
+	ServerVectors      [][]uint64
+	FailoverWait       time.Duration
+	Reject             bool
+	pending            map[uint64]pendingRequest
+	failed             map[uint64]error
+	mu                 sync.Mutex
 }
 
+type pendingRequest struct {
+	serverId uint64
+	reply    chan server.Message
+}
+
+// RequestId is the id of the last request the client issued; a reply to any
+// other request is stale and is ignored. ServerVectors holds, for every
+// server, the latest vector clock the client has seen in its replies.
 type Client struct {
 	Id                 uint64
 	NumberOfServers    uint64
 	WriteVersionVector []uint64
 	ReadVersionVector  []uint64
-	SessionSemantic    uint64
+	Guarantees         Guarantee
+	RequestId          uint64
+	ServerVectors      [][]uint64
+	Reject             bool
 }
 
-func New(id uint64, sessionSemantic uint64, servers []*protocol.Connection) *NClient {
+var ErrTimeout = errors.New("timed out waiting for the server to reply")
+
+func New(id uint64, guarantees Guarantee, servers []*protocol.Connection, transport server.Transport) *NClient {
 	i := uint64(0)
-	serverDecoders := make([]*gob.Decoder, len(servers))
-	serverEncoders := make([]*gob.Encoder, len(servers))
+	serverConnections := make([]server.Conn, len(servers))
 
 	for i < uint64(len(servers)) {
-		c, err := net.Dial(servers[i].Network, servers[i].Address)
+		c, err := transport.Dial(servers[i])
 
 		if err != nil {
 			fmt.Println(err)
 		}
-		serverDecoders[i] = gob.NewDecoder(c)
-		serverEncoders[i] = gob.NewEncoder(c)
+		serverConnections[i] = c
 		i += 1
 	}
 
-	return &NClient{
+	return newNClient(id, guarantees, serverConnections)
+}
+
+func newNClient(id uint64, guarantees Guarantee, serverConnections []server.Conn) *NClient {
+	c := &NClient{
 		Id:                 id,
-		ServerDecoders:     serverDecoders,
-		ServerEncoder:      serverEncoders,
-		WriteVersionVector: make([]uint64, len(servers)),
-		ReadVersionVector:  make([]uint64, len(servers)),
-		SessionSemantic:    sessionSemantic,
+		ServerConnections:  serverConnections,
+		WriteVersionVector: make([]uint64, len(serverConnections)),
+		ReadVersionVector:  make([]uint64, len(serverConnections)),
+		Guarantees:         guarantees,
+		ServerVectors:      make([][]uint64, len(serverConnections)),
+		pending:            make(map[uint64]pendingRequest),
+		failed:             make(map[uint64]error),
+	}
+
+	var i = uint64(0)
+	for i < uint64(len(serverConnections)) {
+		if serverConnections[i] != nil {
+			go c.receive(i)
+		}
+		i++
 	}
+	return c
 }
 
-func Start(config ConfigurationInfo, servers []*protocol.Connection) error {
+func Start(config ConfigurationInfo, servers []*protocol.Connection, transport server.Transport) error {
 	i := uint64(0)
 
 	var NClients = make([]*NClient, config.Threads)
+	var keyGenerators = make([]*keyGenerator, config.Threads)
+	profile := workloadProfile(config)
+
+	var records atomic.Uint64
+	records.Store(maxTwoInts(profileKeys(config, profile).Keys, 1))
 
 	for i < uint64(config.Threads) {
-		NClients[i] = New(i, config.SessionSemantic, servers)
+		var err error
+		keyGenerators[i], err = newKeyGenerator(profileKeys(config, profile), i, &records)
+		if err != nil {
+			fmt.Println(err)
+			return err
+		}
+		NClients[i] = New(i, config.Guarantees, servers, transport)
+		NClients[i].FailoverWait = time.Duration(config.FailoverWait) * time.Millisecond
+		NClients[i].Reject = config.Reject
 		i += 1
 	}
 
@@ -87,6 +145,16 @@ func Start(config ConfigurationInfo, servers []*protocol.Connection) error {
 	avg_time := float64(0)
 	total_latency := time.Duration(0 * time.Microsecond)
 	ops := uint64(0)
+	history := make([]checker.Event, 0)
+	var latencies = make([]Histogram, len(operationNames))
+	samples := make([]Sample, 0)
+	sampleInterval := time.Second
+	if config.SampleInterval != 0 {
+		sampleInterval = time.Duration(config.SampleInterval) * time.Millisecond
+	}
+	var waits Histogram
+	failed := uint64(0)
+	timeouts := uint64(0)
 
 	var wg sync.WaitGroup
 	var barrier sync.WaitGroup
@@ -98,18 +166,49 @@ func Start(config ConfigurationInfo, servers []*protocol.Connection) error {
 		j := i
 		go func(c *NClient) error {
 			index := uint64(0)
+			sequence := uint64(0)
 			serverId := uint64(0)
 			readServerId := uint64(0)
 			writeServerId := uint64(0)
 			var start_time time.Time
 			var end_time time.Time
-			var operation_start uint64
-			var operation_end uint64
 			var operation uint64
 			var temp time.Duration
+			var m server.Message
+			var err error
+
+			keys := keyGenerators[c.Id]
+			events := make([]checker.Event, 0)
+
+			// The threads load the records between them before the run starts.
+			key := c.Id
+			for key < profile.RecordCount {
+				k := binary.BigEndian.AppendUint64(nil, key)
+				v := operationValue(profile, c.Id, sequence)
+				m, err = c.do(context.Background(), 1, c.Id%uint64(len(servers)), k, v, c.Guarantees)
+				if err == nil {
+					err = server.StatusError(m.S2C_Client_Status)
+				}
+				if err != nil {
+					fmt.Println(err)
+					break
+				}
+				if config.HistoryFile != "" {
+					events = append(events, checker.Event{
+						Client:        c.Id,
+						Index:         sequence,
+						OperationType: 1,
+						Key:           k,
+						Value:         v,
+						VersionVector: m.S2C_Client_VersionVector,
+						Server:        m.S2C_Server_Id,
+						Guarantees:    c.Guarantees.CheckerGuarantees(),
+					})
+				}
+				sequence++
+				key += config.Threads
+			}
 
-			r := rand.New(rand.NewPCG(1, 2))
-			z := rand.NewZipf(r, 3, 10, 100)
 			barrier.Done()
 			barrier.Wait()
 			defer wg.Done()
@@ -117,12 +216,19 @@ func Start(config ConfigurationInfo, servers []*protocol.Connection) error {
 			log_time := false
 			initial_time := time.Now()
 			latency := time.Duration(0)
+			var operationLatencies = make([]Histogram, len(operationNames))
+			var waited Histogram
+			series := make([]Sample, 0)
+			completed := uint64(0)
+			failures := uint64(0)
+			timedOut := uint64(0)
 
 			for {
-				if uint64(rand.IntN(99)) < config.Workload {
-					operation = uint64(1)
-				} else {
+				kind := chooseOperation(profile, keys.r)
+				if kind == OperationRead || kind == OperationScan {
 					operation = uint64(0)
+				} else {
+					operation = uint64(1)
 				}
 
 				if config.PrimaryBackUpRoundRobin {
@@ -149,45 +255,115 @@ func Start(config ConfigurationInfo, servers []*protocol.Connection) error {
 
 				if !log_time && time.Since(initial_time) > lower_bound {
 					start_time = time.Now()
-					operation_start = index
 					log_time = true
 				}
 				if log_time && time.Since(start_time) > (upper_bound) {
 					end_time = time.Now()
-					operation_end = index
 					break
 				}
 
-				v := z.Uint64()
-
-				outGoingMessage := handler(c, operation, serverId, v, server.Message{})
+				key := keys.next()
+				if kind == OperationInsert {
+					key = records.Add(1) - 1
+				}
+				steps := operationSteps(profile, kind, key, records.Load(), keys.r)
 
-				var m server.Message
+				ctx := context.Background()
+				cancel := context.CancelFunc(func() {})
+				if config.Timeout != 0 {
+					ctx, cancel = context.WithTimeout(ctx, time.Duration(config.Timeout)*time.Millisecond)
+				}
 
 				sent_time := time.Now()
+				wait := uint64(0)
+
+				for _, st := range steps {
+					k := binary.BigEndian.AppendUint64(nil, st.key)
+					v := operationValue(profile, c.Id, sequence)
+					if st.operationType == uint64(0) {
+						serverId = readServerId
+					} else {
+						serverId = writeServerId
+					}
 
-				if operation == uint64(0) {
-					serverId = readServerId
-				} else {
-					serverId = writeServerId
+					m, err = c.do(ctx, st.operationType, serverId, k, v, c.Guarantees)
+					// A write that timed out may still take effect, so it is
+					// recorded as indeterminate and its value is not reused.
+					if err != nil && st.operationType == uint64(1) {
+						if config.HistoryFile != "" {
+							events = append(events, checker.Event{
+								Client:        c.Id,
+								Index:         sequence,
+								OperationType: 1,
+								Key:           k,
+								Value:         v,
+								Server:        serverId,
+								Guarantees:    c.Guarantees.CheckerGuarantees(),
+								Indeterminate: true,
+							})
+						}
+						sequence++
+					}
+					if err != nil || m.S2C_Client_Status != server.StatusOk {
+						break
+					}
+					wait += m.S2C_Client_Wait
+
+					if config.HistoryFile != "" {
+						value := v
+						if st.operationType == uint64(0) {
+							value = m.S2C_Client_Data
+						}
+						events = append(events, checker.Event{
+							Client:        c.Id,
+							Index:         sequence,
+							OperationType: st.operationType,
+							Key:           k,
+							Value:         value,
+							VersionVector: m.S2C_Client_VersionVector,
+							Server:        m.S2C_Server_Id,
+							Guarantees:    c.Guarantees.CheckerGuarantees(),
+						})
+					}
+					sequence++
 				}
-
-				err := c.ServerEncoder[serverId].Encode(&outGoingMessage)
-				if err != nil {
+				cancel()
+				if errors.Is(err, ErrTimeout) {
+					fmt.Println(err)
+					if log_time {
+						timedOut++
+					}
+					index++
+					continue
+				}
+				if err != nil && m.MessageType != 4 {
 					fmt.Print(err)
 					return err
 				}
 
-				err = c.ServerDecoders[serverId].Decode(&m)
-				if err != nil {
-					fmt.Print(err)
-					return err
+				// Refused operations are only counted, since a fast refusal
+				// would otherwise make the latencies look better.
+				if m.S2C_Client_Status != server.StatusOk {
+					fmt.Println(server.StatusError(m.S2C_Client_Status))
+					if log_time {
+						failures++
+					}
+					index++
+					continue
 				}
 
 				temp = (time.Since(sent_time))
-				latency = latency + temp
+				if log_time {
+					latency = latency + temp
+					n := uint64(time.Since(start_time) / sampleInterval)
+					series = recordSample(series, n, kind, uint64(temp.Microseconds()), wait)
+					operationLatencies[kind].Record(uint64(temp.Microseconds()))
+					if wait != 0 {
+						waited.Record(wait)
+					}
+					completed++
+				}
 
-				handler(c, 2, 0, 0, m)
 				index++
 			}
 
@@ -198,8 +374,16 @@ func Start(config ConfigurationInfo, servers []*protocol.Connection) error {
 			} else {
 				avg_time = (avg_time + (end_time.Sub(start_time).Seconds())) / 2
 			}
-			ops += operation_end - operation_start
+			ops += completed
 			total_latency = total_latency + latency
+			history = append(history, events...)
+			for kind := range operationLatencies {
+				latencies[kind].Merge(operationLatencies[kind])
+			}
+			waits.Merge(waited)
+			samples = mergeSamples(samples, series)
+			failed += failures
+			timeouts += timedOut
 			l.Unlock()
 			return nil
 		}(NClients[j])
@@ -214,10 +398,68 @@ func Start(config ConfigurationInfo, servers []*protocol.Connection) error {
 	fmt.Println("average_time:", int(avg_time), "sec")
 	fmt.Println("throughput:", int(float64(ops)/(avg_time)), "ops/sec")
 	fmt.Println("latency:", int(float64(total_latency.Microseconds())/float64(ops)), "us")
+	fmt.Println("failed_operations:", failed)
+	fmt.Println("timed_out_operations:", timeouts)
+	for kind := range latencies {
+		if kind <= int(OperationUpdate) || latencies[kind].Count != 0 {
+			printLatencies(operationNames[kind], "latency", &latencies[kind])
+		}
+	}
+	printLatencies("unsatisfied", "wait", &waits)
+
+	if config.ResultsFile != "" {
+		err := WriteResults(config.ResultsFile, Results{
+			Config:     config,
+			Servers:    servers,
+			Duration:   avg_time,
+			Operations: ops,
+			Throughput: float64(ops) / avg_time,
+			Failed:     failed,
+			Timeouts:   timeouts,
+			Reads:      summarize(&latencies[OperationRead]),
+			Writes:     summarize(&latencies[OperationUpdate]),
+			Inserts:    summarize(&latencies[OperationInsert]),
+			Scans:      summarize(&latencies[OperationScan]),
+			RMWs:       summarize(&latencies[OperationReadModifyWrite]),
+			Wait:       summarize(&waits),
+			TimeSeries: finishSamples(samples, sampleInterval),
+		})
+		if err != nil {
+			fmt.Println(err)
+			return err
+		}
+	}
+
+	if config.HistoryFile != "" {
+		f, err := os.Create(config.HistoryFile)
+		if err != nil {
+			fmt.Println(err)
+			return err
+		}
+		defer f.Close()
+		w := bufio.NewWriter(f)
+		err = checker.WriteHistory(w, history)
+		if err == nil {
+			err = w.Flush()
+		}
+		if err != nil {
+			fmt.Println(err)
+			return err
+		}
+	}
 
 	return nil
 }
 
+func printLatencies(name string, metric string, h *Histogram) {
+	fmt.Println(name+"_operations:", h.Count)
+	fmt.Println(name+"_"+metric+"_p50:", h.Percentile(50), "us")
+	fmt.Println(name+"_"+metric+"_p90:", h.Percentile(90), "us")
+	fmt.Println(name+"_"+metric+"_p99:", h.Percentile(99), "us")
+	fmt.Println(name+"_"+metric+"_p99.9:", h.Percentile(99.9), "us")
+	fmt.Println(name+"_"+metric+"_max:", h.Max, "us")
+}
+
 func maxTwoInts(x uint64, y uint64) uint64 {
 	if x > y {
 		return x
@@ -237,88 +479,62 @@ func maxTS(t1 []uint64, t2 []uint64) []uint64 {
 	return output
 }
 
-func read(client Client, serverId uint64) server.Message {
+func read(client Client, serverId uint64, key []byte, guarantees Guarantee) server.Message {
 	var reply = server.Message{}
-	if client.SessionSemantic == 0 || client.SessionSemantic == 1 || client.SessionSemantic == 2 { // Eventual WFR MW
-		reply.MessageType = 0
-		reply.C2S_Client_Id = client.Id
-		reply.C2S_Client_OperationType = 0
-		reply.C2S_Client_Data = 0
-		reply.C2S_Server_Id = serverId
-		reply.C2S_Client_VersionVector = make([]uint64, client.NumberOfServers)
-	} else if client.SessionSemantic == 3 { // MR
-		reply.MessageType = 0
-		reply.C2S_Client_Id = client.Id
-		reply.C2S_Client_OperationType = 0
-		reply.C2S_Client_Data = 0
-		reply.C2S_Server_Id = serverId
-		reply.C2S_Client_VersionVector = client.ReadVersionVector
-	} else if client.SessionSemantic == 4 { // RMW
-		reply.MessageType = 0
-		reply.C2S_Client_Id = client.Id
-		reply.C2S_Client_OperationType = 0
-		reply.C2S_Client_Data = 0
-		reply.C2S_Server_Id = serverId
-		reply.C2S_Client_VersionVector = client.WriteVersionVector
-	} else if client.SessionSemantic == 5 { // Causal
-		reply.MessageType = 0
-		reply.C2S_Client_Id = client.Id
-		reply.C2S_Client_OperationType = 0
-		reply.C2S_Client_Data = 0
-		reply.C2S_Server_Id = serverId
-		reply.C2S_Client_VersionVector = maxTS(client.WriteVersionVector, client.ReadVersionVector)
-	}
+	reply.MessageType = 0
+	reply.C2S_Client_Id = client.Id
+	reply.C2S_Client_OperationType = 0
+	reply.C2S_Client_Key = key
+	reply.C2S_Client_Data = nil
+	reply.C2S_Server_Id = serverId
+	reply.C2S_Client_VersionVector = dependencies(client, 0, guarantees)
+	reply.C2S_Client_RequestId = client.RequestId
+	reply.C2S_Client_Reject = client.Reject
 
 	return reply
 }
 
-func write(client Client, serverId uint64, value uint64) server.Message {
+func write(client Client, serverId uint64, key []byte, value []byte, guarantees Guarantee) server.Message {
 	var reply = server.Message{}
-	if client.SessionSemantic == 0 || client.SessionSemantic == 3 || client.SessionSemantic == 4 { // Eventual MR RMW
-		reply.MessageType = 0
-		reply.C2S_Client_Id = client.Id
-		reply.C2S_Client_OperationType = 1
-		reply.C2S_Client_Data = value
-		reply.C2S_Server_Id = serverId
-		reply.C2S_Client_VersionVector = make([]uint64, client.NumberOfServers)
-	} else if client.SessionSemantic == 1 { // WFR
-		reply.MessageType = 0
-		reply.C2S_Client_Id = client.Id
-		reply.C2S_Client_OperationType = 1
-		reply.C2S_Client_Data = value
-		reply.C2S_Server_Id = serverId
-		reply.C2S_Client_VersionVector = client.ReadVersionVector
-	} else if client.SessionSemantic == 2 { // MW
-		reply.MessageType = 0
-		reply.C2S_Client_Id = client.Id
-		reply.C2S_Client_OperationType = 1
-		reply.C2S_Client_Data = value
-		reply.C2S_Server_Id = serverId
-		reply.C2S_Client_VersionVector = client.WriteVersionVector
-	} else if client.SessionSemantic == 5 { // Causal
-		reply.MessageType = 0
-		reply.C2S_Client_Id = client.Id
-		reply.C2S_Client_OperationType = 1
-		reply.C2S_Client_Data = value
-		reply.C2S_Server_Id = serverId
-		reply.C2S_Client_VersionVector = maxTS(client.WriteVersionVector, client.ReadVersionVector)
-	}
+	reply.MessageType = 0
+	reply.C2S_Client_Id = client.Id
+	reply.C2S_Client_OperationType = 1
+	reply.C2S_Client_Key = key
+	reply.C2S_Client_Data = value
+	reply.C2S_Server_Id = serverId
+	reply.C2S_Client_VersionVector = dependencies(client, 1, guarantees)
+	reply.C2S_Client_RequestId = client.RequestId
+	reply.C2S_Client_Reject = client.Reject
 
 	return reply
 }
 
-func processRequest(client Client, requestType uint64, serverId uint64, value uint64, ackMessage server.Message) (Client, server.Message) {
+// The dependency vector of a read or write is computed from guarantees, so
+// each operation of a session can ask for its own set; Client.Guarantees is
+// only the session's default.
+func ProcessRequest(client Client, requestType uint64, serverId uint64, key []byte, value []byte, guarantees Guarantee, ackMessage server.Message) (Client, server.Message) {
 	var msg = server.Message{}
 	if requestType == 0 {
-		msg = read(client, serverId)
+		client.RequestId += 1
+		msg = read(client, serverId, key, guarantees)
 	} else if requestType == 1 {
-		msg = write(client, serverId, value)
+		client.RequestId += 1
+		msg = write(client, serverId, key, value, guarantees)
 	} else if requestType == 2 {
+		if ackMessage.S2C_Client_RequestId != client.RequestId {
+			return client, server.Message{}
+		}
+		client = observeServer(client, ackMessage)
+		if ackMessage.S2C_Client_Status != server.StatusOk {
+			return client, server.Message{}
+		}
+		// A write is not ordered after earlier ones unless MonotonicWrites is
+		// held, so the session vectors accumulate rather than take the latest.
 		if ackMessage.S2C_Client_OperationType == 0 {
-			client.ReadVersionVector = ackMessage.S2C_Client_VersionVector
+			client.ReadVersionVector = maxTS(client.ReadVersionVector, ackMessage.S2C_Client_VersionVector)
 		}
 		if ackMessage.S2C_Client_OperationType == 1 {
-			client.WriteVersionVector = ackMessage.S2C_Client_VersionVector
+			client.WriteVersionVector = maxTS(client.WriteVersionVector, ackMessage.S2C_Client_VersionVector)
 		}
 		return client, server.Message{}
 	}
@@ -326,17 +542,198 @@ func processRequest(client Client, requestType uint64, serverId uint64, value ui
 	return client, msg
 }
 
-func handler(c *NClient, requestType uint64, serverId uint64, value uint64, ackMessage server.Message) server.Message {
-	nc, outGoingMessage := processRequest(Client{
-		Id:                 c.Id,
-		NumberOfServers:    uint64(len(c.ServerEncoder)),
-		WriteVersionVector: c.WriteVersionVector,
-		ReadVersionVector:  c.ReadVersionVector,
-		SessionSemantic:    c.SessionSemantic,
-	}, requestType, serverId, value, ackMessage)
+func handler(c *NClient, requestType uint64, serverId uint64, key []byte, value []byte, guarantees Guarantee, ackMessage server.Message) server.Message {
+	nc, outGoingMessage := ProcessRequest(c.state(), requestType, serverId, key, value, guarantees, ackMessage)
 
 	c.WriteVersionVector = nc.WriteVersionVector
 	c.ReadVersionVector = nc.ReadVersionVector
+	c.RequestId = nc.RequestId
+	c.ServerVectors = nc.ServerVectors
 
 	return outGoingMessage
 }
+
+func (c *NClient) state() Client {
+	return Client{
+		Id:                 c.Id,
+		NumberOfServers:    uint64(len(c.ServerConnections)),
+		WriteVersionVector: c.WriteVersionVector,
+		ReadVersionVector:  c.ReadVersionVector,
+		Guarantees:         c.Guarantees,
+		RequestId:          c.RequestId,
+		ServerVectors:      c.ServerVectors,
+		Reject:             c.Reject,
+	}
+}
+
+// Replies are read off every connection by its own goroutine and handed to the
+// request waiting for them, so a request that is abandoned does not leave its
+// reply to be mistaken for the reply to the next one.
+func (c *NClient) receive(serverId uint64) {
+	for {
+		var m server.Message
+		err := c.ServerConnections[serverId].Receive(&m)
+
+		c.mu.Lock()
+		if err != nil {
+			c.failed[serverId] = err
+			for id, p := range c.pending {
+				if p.serverId == serverId {
+					close(p.reply)
+					delete(c.pending, id)
+				}
+			}
+			c.mu.Unlock()
+			return
+		}
+		p, ok := c.pending[m.S2C_Client_RequestId]
+		if ok {
+			delete(c.pending, m.S2C_Client_RequestId)
+		}
+		c.mu.Unlock()
+
+		if ok {
+			p.reply <- m
+		}
+	}
+}
+
+// A server is reachable if it was connected to and its connection has not
+// failed since.
+func (c *NClient) reachable(serverId uint64) bool {
+	if serverId >= uint64(len(c.ServerConnections)) || c.ServerConnections[serverId] == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.failed[serverId] == nil
+}
+
+func (c *NClient) cancel(serverId uint64, requestId uint64) {
+	cancel := server.Message{
+		MessageType:          6,
+		C2S_Client_Id:        c.Id,
+		C2S_Server_Id:        serverId,
+		C2S_Client_RequestId: requestId,
+	}
+	c.ServerConnections[serverId].Send(&cancel)
+}
+
+// send waits for the reply to request from its server. If the request is
+// still unanswered after FailoverWait and another server is known to be able
+// to serve it, the request is cancelled so that it can be retried there; the
+// reply is then either the server's cancellation or, if the server served the
+// request first, the reply to the request itself.
+func (c *NClient) send(ctx context.Context, request server.Message) (server.Message, error) {
+	serverId := request.C2S_Server_Id
+	requestId := request.C2S_Client_RequestId
+	reply := make(chan server.Message, 1)
+
+	c.mu.Lock()
+	err := c.failed[serverId]
+	if err == nil {
+		c.pending[requestId] = pendingRequest{serverId: serverId, reply: reply}
+	}
+	c.mu.Unlock()
+	if err != nil {
+		return server.Message{}, err
+	}
+
+	err = c.ServerConnections[serverId].Send(&request)
+	if err != nil {
+		c.mu.Lock()
+		delete(c.pending, requestId)
+		c.mu.Unlock()
+		return server.Message{}, err
+	}
+
+	var failover <-chan time.Time
+	if c.FailoverWait != 0 {
+		t := time.NewTimer(c.FailoverWait)
+		defer t.Stop()
+		failover = t.C
+	}
+
+	for {
+		select {
+		case m, ok := <-reply:
+			if !ok {
+				c.mu.Lock()
+				err = c.failed[serverId]
+				c.mu.Unlock()
+				return server.Message{}, err
+			}
+			return m, nil
+		case <-failover:
+			failover = nil
+			_, ok := failoverServer(c.state(), serverId, request.C2S_Client_VersionVector)
+			if ok {
+				c.cancel(serverId, requestId)
+			}
+		case <-ctx.Done():
+			c.mu.Lock()
+			delete(c.pending, requestId)
+			c.mu.Unlock()
+
+			c.cancel(serverId, requestId)
+			return server.Message{}, contextError(ctx.Err())
+		}
+	}
+}
+
+func (c *NClient) do(ctx context.Context, requestType uint64, serverId uint64, key []byte, value []byte, guarantees Guarantee) (server.Message, error) {
+	if serverId >= uint64(len(c.ServerConnections)) || c.ServerConnections[serverId] == nil {
+		return server.Message{}, fmt.Errorf("no connection to server %d", serverId)
+	}
+	err := ctx.Err()
+	if err != nil {
+		return server.Message{}, contextError(err)
+	}
+
+	request := handler(c, requestType, serverId, key, value, guarantees, server.Message{})
+	for {
+		m, err := c.send(ctx, request)
+		if err != nil {
+			return server.Message{}, err
+		}
+		handler(c, 2, 0, nil, nil, guarantees, m)
+
+		if m.S2C_Client_Status != server.StatusUnsatisfied && m.S2C_Client_Status != server.StatusCancelled {
+			return m, server.StatusError(m.S2C_Client_Status)
+		}
+
+		// When no server is known to be able to serve the request, it waits
+		// at the server that turned it away until that server catches up.
+		next, ok := failoverServer(c.state(), request.C2S_Server_Id, request.C2S_Client_VersionVector)
+		if ok {
+			request.C2S_Server_Id = next
+		} else {
+			request.C2S_Client_Reject = false
+		}
+		if c.ServerConnections[request.C2S_Server_Id] == nil {
+			return m, server.StatusError(m.S2C_Client_Status)
+		}
+	}
+}
+
+func contextError(err error) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ErrTimeout
+	}
+	return err
+}
+
+// Read and Write block until serverId replies or ctx is done. Neither is safe
+// to call concurrently on the same NClient.
+func (c *NClient) Read(ctx context.Context, serverId uint64, key []byte, guarantees Guarantee) ([]byte, error) {
+	m, err := c.do(ctx, 0, serverId, key, nil, guarantees)
+	if err != nil {
+		return nil, err
+	}
+	return m.S2C_Client_Data, nil
+}
+
+func (c *NClient) Write(ctx context.Context, serverId uint64, key []byte, value []byte, guarantees Guarantee) error {
+	_, err := c.do(ctx, 1, serverId, key, value, guarantees)
+	return err
+}
@@ -0,0 +1,50 @@
+package client
+
+import "github.com/alanwang67/session_semantics/server"
+
+func dominates(v1 []uint64, v2 []uint64) bool {
+	if len(v1) != len(v2) {
+		return false
+	}
+	var i = uint64(0)
+	for i < uint64(len(v1)) {
+		if v1[i] < v2[i] {
+			return false
+		}
+		i++
+	}
+	return true
+}
+
+// Every reply carries a vector the server had reached when it sent it: its own
+// clock for reads and refusals, and the new operation's vector for writes.
+func observeServer(client Client, ackMessage server.Message) Client {
+	serverId := ackMessage.S2C_Server_Id
+	if serverId >= uint64(len(client.ServerVectors)) || uint64(len(ackMessage.S2C_Client_VersionVector)) != client.NumberOfServers {
+		return client
+	}
+
+	vectors := append([][]uint64(nil), client.ServerVectors...)
+	if vectors[serverId] == nil {
+		vectors[serverId] = append([]uint64(nil), ackMessage.S2C_Client_VersionVector...)
+	} else {
+		vectors[serverId] = maxTS(vectors[serverId], ackMessage.S2C_Client_VersionVector)
+	}
+	client.ServerVectors = vectors
+	return client
+}
+
+// failoverServer picks the first server after serverId that the client knows
+// has reached the dependency vector, so retries spread over the replicas.
+func failoverServer(client Client, serverId uint64, dependencies []uint64) (uint64, bool) {
+	n := uint64(len(client.ServerVectors))
+	var i = uint64(1)
+	for i < n {
+		next := (serverId + i) % n
+		if dominates(client.ServerVectors[next], dependencies) {
+			return next, true
+		}
+		i++
+	}
+	return serverId, false
+}
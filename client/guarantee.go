@@ -0,0 +1,145 @@
+package client
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/alanwang67/session_semantics/checker"
+)
+
+// Guarantee is a set of session guarantees. Causal consistency is the union
+// of all four; the empty set is eventual consistency.
+type Guarantee uint64
+
+const (
+	ReadYourWrites Guarantee = 1 << iota
+	MonotonicReads
+	WritesFollowReads
+	MonotonicWrites
+
+	Eventual Guarantee = 0
+	Causal             = ReadYourWrites | MonotonicReads | WritesFollowReads | MonotonicWrites
+)
+
+var guaranteeNames = []struct {
+	g       Guarantee
+	name    string
+	checker string
+}{
+	{ReadYourWrites, "RYW", checker.ReadYourWrites},
+	{MonotonicReads, "MR", checker.MonotonicReads},
+	{WritesFollowReads, "WFR", checker.WritesFollowReads},
+	{MonotonicWrites, "MW", checker.MonotonicWrites},
+}
+
+// The numbers the benchmark used to take on the command line.
+var legacySessionSemantics = []Guarantee{Eventual, WritesFollowReads, MonotonicWrites, MonotonicReads, ReadYourWrites, Causal}
+
+var ErrUnknownGuarantee = errors.New("unknown session guarantee")
+
+func (g Guarantee) Has(other Guarantee) bool {
+	return g&other == other
+}
+
+func (g Guarantee) String() string {
+	if g == Eventual {
+		return "Eventual"
+	}
+	if g == Causal {
+		return "Causal"
+	}
+	names := make([]string, 0)
+	for _, n := range guaranteeNames {
+		if g.Has(n.g) {
+			names = append(names, n.name)
+		}
+	}
+	return strings.Join(names, "+")
+}
+
+// CheckerGuarantees names the guarantees in g the way the checker does, for
+// the events of a session that asked for them.
+func (g Guarantee) CheckerGuarantees() []string {
+	names := make([]string, 0)
+	for _, n := range guaranteeNames {
+		if g.Has(n.g) {
+			names = append(names, n.checker)
+		}
+	}
+	if g.Has(Causal) {
+		names = append(names, checker.Causal)
+	}
+	return names
+}
+
+// ParseGuarantee accepts either one of the legacy session semantic numbers
+// 0-5 or guarantee names joined by "+", such as "MR+RYW".
+func ParseGuarantee(s string) (Guarantee, error) {
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err == nil {
+		if n >= uint64(len(legacySessionSemantics)) {
+			return Eventual, ErrUnknownGuarantee
+		}
+		return legacySessionSemantics[n], nil
+	}
+
+	var g = Eventual
+	for _, part := range strings.Split(s, "+") {
+		part = strings.ToUpper(strings.TrimSpace(part))
+		switch part {
+		case "EVENTUAL":
+			continue
+		case "CAUSAL":
+			g |= Causal
+			continue
+		}
+
+		found := false
+		for _, n := range guaranteeNames {
+			if n.name == part {
+				g |= n.g
+				found = true
+			}
+		}
+		if !found {
+			return Eventual, ErrUnknownGuarantee
+		}
+	}
+	return g, nil
+}
+
+func (g Guarantee) MarshalText() ([]byte, error) {
+	return []byte(g.String()), nil
+}
+
+func (g *Guarantee) UnmarshalText(text []byte) error {
+	parsed, err := ParseGuarantee(string(text))
+	if err != nil {
+		return err
+	}
+	*g = parsed
+	return nil
+}
+
+// dependencies is the version vector a server must have reached before it
+// may serve the operation under the guarantees g.
+func dependencies(client Client, operationType uint64, g Guarantee) []uint64 {
+	var vv = make([]uint64, client.NumberOfServers)
+	if operationType == 0 {
+		if g.Has(MonotonicReads) {
+			vv = maxTS(vv, client.ReadVersionVector)
+		}
+		if g.Has(ReadYourWrites) {
+			vv = maxTS(vv, client.WriteVersionVector)
+		}
+	} else {
+		if g.Has(WritesFollowReads) {
+			vv = maxTS(vv, client.ReadVersionVector)
+		}
+		if g.Has(MonotonicWrites) {
+			vv = maxTS(vv, client.WriteVersionVector)
+		}
+	}
+	return vv
+}
@@ -0,0 +1,51 @@
+package client
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseGuarantee(t *testing.T) {
+	tests := []struct {
+		s string
+		g Guarantee
+	}{
+		{"MR+RYW", MonotonicReads | ReadYourWrites},
+		{"ryw + mr", MonotonicReads | ReadYourWrites},
+		{"WFR+MW", WritesFollowReads | MonotonicWrites},
+		{"Causal", Causal},
+		{"Eventual", Eventual},
+		{"0", Eventual},
+		{"1", WritesFollowReads},
+		{"2", MonotonicWrites},
+		{"3", MonotonicReads},
+		{"4", ReadYourWrites},
+		{"5", Causal},
+	}
+	for _, test := range tests {
+		g, err := ParseGuarantee(test.s)
+		if err != nil {
+			t.Errorf("ParseGuarantee(%q): %v", test.s, err)
+		} else if g != test.g {
+			t.Errorf("ParseGuarantee(%q) = %v, want %v", test.s, g, test.g)
+		}
+	}
+
+	for _, s := range []string{"6", "MR+XYZ", "", "MR+"} {
+		_, err := ParseGuarantee(s)
+		if !errors.Is(err, ErrUnknownGuarantee) {
+			t.Errorf("ParseGuarantee(%q) returned %v, want %v", s, err, ErrUnknownGuarantee)
+		}
+	}
+}
+
+func TestGuaranteeStringRoundTrips(t *testing.T) {
+	var g = Guarantee(0)
+	for g <= Causal {
+		parsed, err := ParseGuarantee(g.String())
+		if err != nil || parsed != g {
+			t.Errorf("ParseGuarantee(%q) = %v, %v", g.String(), parsed, err)
+		}
+		g++
+	}
+}
@@ -0,0 +1,97 @@
+package client
+
+import (
+	"math/bits"
+)
+
+// Latencies are recorded in microseconds into log-linear buckets, as in an
+// HDR histogram: values below 2^histogramBits are exact, and above that each
+// power of two is split into 2^(histogramBits-1) buckets, so a recorded value
+// is off by less than 1/2^(histogramBits-1) of itself.
+const histogramBits = 8
+
+type Histogram struct {
+	Counts []uint64
+	Count  uint64
+	Total  uint64
+	Max    uint64
+}
+
+func histogramIndex(value uint64) uint64 {
+	if value < 1<<histogramBits {
+		return value
+	}
+	shift := uint64(bits.Len64(value)) - histogramBits
+	return shift<<(histogramBits-1) + value>>shift
+}
+
+// The largest value that falls in the same bucket as index.
+func histogramValue(index uint64) uint64 {
+	if index < 1<<histogramBits {
+		return index
+	}
+	shift := index>>(histogramBits-1) - 1
+	sub := index & (1<<(histogramBits-1) - 1)
+	return (sub+1<<(histogramBits-1))<<shift + (1<<shift - 1)
+}
+
+func (h *Histogram) Record(value uint64) {
+	index := histogramIndex(value)
+	for uint64(len(h.Counts)) <= index {
+		h.Counts = append(h.Counts, 0)
+	}
+	h.Counts[index] += 1
+	h.Count += 1
+	h.Total += value
+	h.Max = maxTwoInts(h.Max, value)
+}
+
+func (h *Histogram) Merge(other Histogram) {
+	for uint64(len(h.Counts)) < uint64(len(other.Counts)) {
+		h.Counts = append(h.Counts, 0)
+	}
+	var i = uint64(0)
+	for i < uint64(len(other.Counts)) {
+		h.Counts[i] += other.Counts[i]
+		i++
+	}
+	h.Count += other.Count
+	h.Total += other.Total
+	h.Max = maxTwoInts(h.Max, other.Max)
+}
+
+func (h *Histogram) Mean() uint64 {
+	if h.Count == 0 {
+		return 0
+	}
+	return h.Total / h.Count
+}
+
+// The smallest recorded value such that at least percentile percent of the
+// recorded values are no larger, up to the precision of its bucket.
+func (h *Histogram) Percentile(percentile float64) uint64 {
+	if h.Count == 0 {
+		return 0
+	}
+	rank := uint64(percentile / 100 * float64(h.Count))
+	if float64(rank) < percentile/100*float64(h.Count) {
+		rank += 1
+	}
+	if rank == 0 {
+		rank = 1
+	}
+
+	var seen = uint64(0)
+	var i = uint64(0)
+	for i < uint64(len(h.Counts)) {
+		seen += h.Counts[i]
+		if seen >= rank {
+			if histogramValue(i) > h.Max {
+				return h.Max
+			}
+			return histogramValue(i)
+		}
+		i++
+	}
+	return h.Max
+}
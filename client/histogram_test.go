@@ -0,0 +1,94 @@
+package client
+
+import (
+	"testing"
+)
+
+func TestHistogramPercentiles(t *testing.T) {
+	var h Histogram
+	var v = uint64(1)
+	for v <= 1000 {
+		h.Record(v)
+		v++
+	}
+
+	if h.Count != 1000 || h.Max != 1000 || h.Mean() != 500 {
+		t.Fatalf("count %d, max %d, mean %d", h.Count, h.Max, h.Mean())
+	}
+	tests := []struct {
+		percentile float64
+		want       uint64
+	}{
+		{0, 1},
+		{10, 100},
+		{50, 500},
+		{90, 900},
+		{99, 990},
+		{99.9, 999},
+		{100, 1000},
+	}
+	for _, test := range tests {
+		got := h.Percentile(test.percentile)
+		// Values above 2^histogramBits are only as precise as their bucket.
+		if got < test.want || got > test.want+test.want>>(histogramBits-1) {
+			t.Errorf("p%v = %d, want about %d", test.percentile, got, test.want)
+		}
+	}
+}
+
+func TestHistogramSmallValuesAreExact(t *testing.T) {
+	var h Histogram
+	for _, v := range []uint64{3, 1, 4, 1, 5, 9, 2, 6} {
+		h.Record(v)
+	}
+	if h.Percentile(50) != 3 || h.Percentile(100) != 9 || h.Percentile(0) != 1 {
+		t.Fatalf("p0 %d, p50 %d, p100 %d", h.Percentile(0), h.Percentile(50), h.Percentile(100))
+	}
+}
+
+func TestHistogramBucketsCoverTheirValues(t *testing.T) {
+	var v = uint64(1)
+	for v < 1<<40 {
+		index := histogramIndex(v)
+		if histogramValue(index) < v {
+			t.Fatalf("value %d falls in bucket %d, which ends at %d", v, index, histogramValue(index))
+		}
+		if index > 0 && histogramValue(index-1) >= v {
+			t.Fatalf("value %d also fits in bucket %d", v, index-1)
+		}
+		v = v*3/2 + 1
+	}
+}
+
+func TestHistogramMerge(t *testing.T) {
+	var a, b, all Histogram
+	var v = uint64(0)
+	for v < 5000 {
+		if v%3 == 0 {
+			a.Record(v * 7)
+		} else {
+			b.Record(v * 7)
+		}
+		all.Record(v * 7)
+		v++
+	}
+
+	var merged Histogram
+	merged.Merge(a)
+	merged.Merge(b)
+	if merged.Count != all.Count || merged.Total != all.Total || merged.Max != all.Max {
+		t.Fatalf("merged count %d, total %d, max %d; want %d, %d, %d",
+			merged.Count, merged.Total, merged.Max, all.Count, all.Total, all.Max)
+	}
+	for _, p := range []float64{1, 50, 90, 99, 99.9} {
+		if merged.Percentile(p) != all.Percentile(p) {
+			t.Errorf("merged p%v = %d, want %d", p, merged.Percentile(p), all.Percentile(p))
+		}
+	}
+
+	var empty Histogram
+	merged.Merge(empty)
+	if merged.Count != all.Count || merged.Percentile(50) != all.Percentile(50) {
+		t.Fatal("merging an empty histogram changed the result")
+	}
+}
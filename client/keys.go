@@ -0,0 +1,106 @@
+package client
+
+import (
+	"errors"
+	"math/rand/v2"
+	"sync/atomic"
+)
+
+// KeyDistribution chooses which of Keys keys each operation uses:
+//
+//   - "uniform" (the default) picks every key equally often.
+//   - "zipf" picks key k with probability proportional to (V+k)^-S, for k up
+//     to IMax, which defaults to the last key.
+//   - "hotspot" sends HotProbability of the operations to the first
+//     HotFraction of the keys, and the rest to the other keys.
+//   - "latest" picks keys Zipf-distributed by how long ago they were inserted
+//     by any thread, so the most recently inserted keys are the most popular.
+//
+// Every thread draws from its own generator, seeded with Seed and the thread
+// id, so a run picks the same keys every time. The generators share the count
+// of records, which inserts increase.
+type KeyDistribution struct {
+	Type           string
+	Keys           uint64
+	S              float64
+	V              float64
+	IMax           uint64
+	HotFraction    float64
+	HotProbability float64
+	Seed           uint64
+}
+
+var ErrUnknownKeyDistribution = errors.New("unknown key distribution")
+var ErrInvalidKeyDistribution = errors.New("invalid key distribution parameters")
+
+type keyGenerator struct {
+	distribution KeyDistribution
+	r            *rand.Rand
+	zipf         *rand.Zipf
+	records      *atomic.Uint64
+}
+
+func newKeyGenerator(d KeyDistribution, thread uint64, records *atomic.Uint64) (*keyGenerator, error) {
+	if d.Keys == 0 {
+		d.Keys = 1
+	}
+	if d.S == 0 {
+		d.S = 1.1
+	}
+	if d.V == 0 {
+		d.V = 1
+	}
+	if d.IMax == 0 || d.IMax >= d.Keys {
+		d.IMax = d.Keys - 1
+	}
+	if d.HotFraction == 0 {
+		d.HotFraction = 0.2
+	}
+	if d.HotProbability == 0 {
+		d.HotProbability = 0.8
+	}
+
+	g := &keyGenerator{
+		distribution: d,
+		r:            rand.New(rand.NewPCG(d.Seed, thread)),
+		records:      records,
+	}
+	switch d.Type {
+	case "", "uniform":
+	case "zipf", "latest":
+		g.zipf = rand.NewZipf(g.r, d.S, d.V, d.IMax)
+		if g.zipf == nil {
+			return nil, ErrInvalidKeyDistribution
+		}
+	case "hotspot":
+		if d.HotFraction > 1 || d.HotProbability > 1 || d.HotFraction < 0 || d.HotProbability < 0 {
+			return nil, ErrInvalidKeyDistribution
+		}
+	default:
+		return nil, ErrUnknownKeyDistribution
+	}
+	return g, nil
+}
+
+// Inserts add keys after the first Keys. Every distribution but zipf, whose
+// IMax is fixed, then picks from them too; the last of them is the latest.
+func (g *keyGenerator) next() uint64 {
+	d := g.distribution
+	d.Keys = maxTwoInts(d.Keys, g.records.Load())
+	switch d.Type {
+	case "zipf":
+		return g.zipf.Uint64()
+	case "latest":
+		return d.Keys - 1 - g.zipf.Uint64()
+	case "hotspot":
+		hot := uint64(d.HotFraction * float64(d.Keys))
+		if hot == 0 {
+			hot = 1
+		}
+		if hot >= d.Keys || g.r.Float64() < d.HotProbability {
+			return g.r.Uint64N(hot)
+		}
+		return hot + g.r.Uint64N(d.Keys-hot)
+	}
+	return g.r.Uint64N(d.Keys)
+}
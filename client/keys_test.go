@@ -0,0 +1,48 @@
+package client
+
+import (
+	"sync/atomic"
+	"testing"
+)
+
+// Keys inserted by one thread become the most popular keys of every thread
+// that picks the latest keys.
+func TestLatestFollowsInsertsOfEveryThread(t *testing.T) {
+	var records atomic.Uint64
+	records.Store(100)
+	d := KeyDistribution{Type: "latest", Keys: 100, S: 1.5}
+	inserter, err := newKeyGenerator(d, 0, &records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, err := newKeyGenerator(d, 1, &records)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var i = uint64(0)
+	for i < 1000 {
+		key := inserter.next()
+		if key >= 100 {
+			t.Fatalf("picked key %d of 100", key)
+		}
+		i++
+	}
+
+	records.Add(100)
+	recent := uint64(0)
+	i = uint64(0)
+	for i < 1000 {
+		key := reader.next()
+		if key >= 200 {
+			t.Fatalf("picked key %d of 200", key)
+		}
+		if key >= 190 {
+			recent++
+		}
+		i++
+	}
+	if recent < 500 {
+		t.Fatalf("picked one of the 10 latest keys %d times in 1000", recent)
+	}
+}
@@ -0,0 +1,179 @@
+package client
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/alanwang67/session_semantics/protocol"
+)
+
+// Latencies are in microseconds.
+type Latencies struct {
+	Operations uint64
+	Mean       uint64
+	P50        uint64
+	P90        uint64
+	P99        uint64
+	P999       uint64
+	Max        uint64
+}
+
+// A Sample covers the operations that completed in one interval of the
+// measurement window; Time is the end of the interval in seconds since the
+// window opened. Wait only counts the requests that a server parked because
+// it had not yet seen their dependencies.
+type Sample struct {
+	Time       float64
+	Reads      uint64
+	Writes     uint64
+	Inserts    uint64
+	Scans      uint64
+	RMWs       uint64
+	Throughput float64
+	Latency    Latencies
+	Wait       Latencies
+	latency    Histogram
+	wait       Histogram
+}
+
+// Operations and Throughput only count the operations that succeeded in the
+// measurement window; the ones a server refused are Failed and the ones that
+// timed out are Timeouts.
+type Results struct {
+	Config     ConfigurationInfo
+	Servers    []*protocol.Connection
+	Duration   float64
+	Operations uint64
+	Throughput float64
+	Failed     uint64
+	Timeouts   uint64
+	Reads      Latencies
+	Writes     Latencies
+	Inserts    Latencies
+	Scans      Latencies
+	RMWs       Latencies
+	Wait       Latencies
+	TimeSeries []Sample
+}
+
+func summarize(h *Histogram) Latencies {
+	return Latencies{
+		Operations: h.Count,
+		Mean:       h.Mean(),
+		P50:        h.Percentile(50),
+		P90:        h.Percentile(90),
+		P99:        h.Percentile(99),
+		P999:       h.Percentile(99.9),
+		Max:        h.Max,
+	}
+}
+
+func mergeSamples(samples []Sample, other []Sample) []Sample {
+	for uint64(len(samples)) < uint64(len(other)) {
+		samples = append(samples, Sample{})
+	}
+	var i = uint64(0)
+	for i < uint64(len(other)) {
+		samples[i].Reads += other[i].Reads
+		samples[i].Writes += other[i].Writes
+		samples[i].Inserts += other[i].Inserts
+		samples[i].Scans += other[i].Scans
+		samples[i].RMWs += other[i].RMWs
+		samples[i].latency.Merge(other[i].latency)
+		samples[i].wait.Merge(other[i].wait)
+		i++
+	}
+	return samples
+}
+
+func recordSample(samples []Sample, n uint64, operation uint64, latency uint64, wait uint64) []Sample {
+	for uint64(len(samples)) <= n {
+		samples = append(samples, Sample{})
+	}
+	switch operation {
+	case OperationRead:
+		samples[n].Reads++
+	case OperationUpdate:
+		samples[n].Writes++
+	case OperationInsert:
+		samples[n].Inserts++
+	case OperationScan:
+		samples[n].Scans++
+	case OperationReadModifyWrite:
+		samples[n].RMWs++
+	}
+	samples[n].latency.Record(latency)
+	if wait != 0 {
+		samples[n].wait.Record(wait)
+	}
+	return samples
+}
+
+func finishSamples(samples []Sample, interval time.Duration) []Sample {
+	var i = uint64(0)
+	for i < uint64(len(samples)) {
+		samples[i].Time = float64(i+1) * interval.Seconds()
+		operations := samples[i].Reads + samples[i].Writes + samples[i].Inserts + samples[i].Scans + samples[i].RMWs
+		samples[i].Throughput = float64(operations) / interval.Seconds()
+		samples[i].Latency = summarize(&samples[i].latency)
+		samples[i].Wait = summarize(&samples[i].wait)
+		i++
+	}
+	return samples
+}
+
+// WriteResults writes results as JSON to path and the time series as CSV next
+// to it, to path with its extension replaced by .csv. A path that already ends
+// in .csv gets the CSV, and the JSON goes next to it instead.
+func WriteResults(path string, results Results) error {
+	base := path[:len(path)-len(filepath.Ext(path))]
+	jsonPath, csvPath := path, base+".csv"
+	if filepath.Ext(path) == ".csv" {
+		jsonPath = base + ".json"
+	}
+
+	b, err := json.MarshalIndent(results, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(jsonPath, append(b, '\n'), 0644)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(csvPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := csv.NewWriter(f)
+	w.Write([]string{"time", "reads", "writes", "inserts", "scans", "read_modify_writes", "throughput",
+		"latency_p50", "latency_p90", "latency_p99", "latency_p99.9", "latency_max",
+		"unsatisfied", "wait_mean", "wait_p99", "wait_max"})
+	for _, s := range results.TimeSeries {
+		w.Write([]string{
+			strconv.FormatFloat(s.Time, 'f', -1, 64),
+			strconv.FormatUint(s.Reads, 10),
+			strconv.FormatUint(s.Writes, 10),
+			strconv.FormatUint(s.Inserts, 10),
+			strconv.FormatUint(s.Scans, 10),
+			strconv.FormatUint(s.RMWs, 10),
+			strconv.FormatFloat(s.Throughput, 'f', 1, 64),
+			strconv.FormatUint(s.Latency.P50, 10),
+			strconv.FormatUint(s.Latency.P90, 10),
+			strconv.FormatUint(s.Latency.P99, 10),
+			strconv.FormatUint(s.Latency.P999, 10),
+			strconv.FormatUint(s.Latency.Max, 10),
+			strconv.FormatUint(s.Wait.Operations, 10),
+			strconv.FormatUint(s.Wait.Mean, 10),
+			strconv.FormatUint(s.Wait.P99, 10),
+			strconv.FormatUint(s.Wait.Max, 10),
+		})
+	}
+	w.Flush()
+	return w.Error()
+}
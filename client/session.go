@@ -0,0 +1,150 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/alanwang67/session_semantics/protocol"
+	"github.com/alanwang67/session_semantics/server"
+)
+
+var ErrClosed = errors.New("session is closed")
+var ErrNoServers = errors.New("no server can be reached")
+
+// Session is a client of the store for use by other programs. Every operation
+// of a session is ordered by the session's guarantees, and operations issued
+// concurrently on the same session are serialized.
+type Session struct {
+	client     *NClient
+	serverId   uint64
+	guarantees Guarantee
+	closed     bool
+	mu         sync.Mutex
+}
+
+// Open connects to the servers in servers and starts a session with a random
+// client id that is served by a random one of them. Servers that cannot be
+// reached are left out, and Open only fails if none of them can be. A nil
+// transport dials over TCP.
+func Open(servers []*protocol.Connection, guarantees Guarantee, transport server.Transport) (*Session, error) {
+	if len(servers) == 0 {
+		return nil, errors.New("no servers to open a session against")
+	}
+	if transport == nil {
+		transport = server.TCPTransport{}
+	}
+
+	serverConnections := make([]server.Conn, len(servers))
+	connected := make([]uint64, 0, len(servers))
+	var lastErr error
+	var i = uint64(0)
+	for i < uint64(len(servers)) {
+		c, err := transport.Dial(servers[i])
+		if err != nil {
+			lastErr = err
+		} else {
+			serverConnections[i] = c
+			connected = append(connected, i)
+		}
+		i++
+	}
+	if len(connected) == 0 {
+		return nil, lastErr
+	}
+
+	return &Session{
+		client:     newNClient(rand.Uint64(), guarantees, serverConnections),
+		serverId:   connected[rand.IntN(len(connected))],
+		guarantees: guarantees,
+	}, nil
+}
+
+func closeConnections(connections []server.Conn) {
+	for _, c := range connections {
+		if c != nil {
+			c.Close()
+		}
+	}
+}
+
+func (s *Session) do(ctx context.Context, requestType uint64, key []byte, value []byte, guarantees Guarantee) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil, ErrClosed
+	}
+
+	// A session whose server is down moves on to the next one it can reach;
+	// the client's vectors make the new server wait until it has caught up.
+	var tried = uint64(0)
+	for !s.client.reachable(s.serverId) {
+		if tried == uint64(len(s.client.ServerConnections)) {
+			return nil, ErrNoServers
+		}
+		s.serverId = (s.serverId + 1) % uint64(len(s.client.ServerConnections))
+		tried++
+	}
+
+	m, err := s.client.do(ctx, requestType, s.serverId, key, value, guarantees)
+	for err != nil && !s.client.reachable(s.serverId) && tried < uint64(len(s.client.ServerConnections)) {
+		s.serverId = (s.serverId + 1) % uint64(len(s.client.ServerConnections))
+		tried++
+		if s.client.reachable(s.serverId) {
+			m, err = s.client.do(ctx, requestType, s.serverId, key, value, guarantees)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	// A session stays with the server it failed over to.
+	s.serverId = m.S2C_Server_Id
+	return m.S2C_Client_Data, nil
+}
+
+// SetFailover lets an operation that its server cannot serve yet be retried
+// at a server known to have caught up, either after waiting for wait or, if
+// reject is set, as soon as the server turns it away. A zero wait without
+// reject waits at the first server for as long as it takes.
+func (s *Session) SetFailover(wait time.Duration, reject bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.client.FailoverWait = wait
+	s.client.Reject = reject
+}
+
+// Get returns the value of key, or nil if it has never been written.
+func (s *Session) Get(ctx context.Context, key []byte) ([]byte, error) {
+	return s.do(ctx, 0, key, nil, s.guarantees)
+}
+
+func (s *Session) Put(ctx context.Context, key []byte, value []byte) error {
+	_, err := s.do(ctx, 1, key, value, s.guarantees)
+	return err
+}
+
+// GetWith and PutWith override the session's guarantees for one operation.
+func (s *Session) GetWith(ctx context.Context, key []byte, guarantees Guarantee) ([]byte, error) {
+	return s.do(ctx, 0, key, nil, guarantees)
+}
+
+func (s *Session) PutWith(ctx context.Context, key []byte, value []byte, guarantees Guarantee) error {
+	_, err := s.do(ctx, 1, key, value, guarantees)
+	return err
+}
+
+func (s *Session) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrClosed
+	}
+	s.closed = true
+	closeConnections(s.client.ServerConnections)
+	return nil
+}
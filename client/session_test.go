@@ -0,0 +1,211 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/alanwang67/session_semantics/protocol"
+	"github.com/alanwang67/session_semantics/server"
+)
+
+// Only the first up of the n servers are started. Every server keeps a
+// durable log, so it takes writes without first hearing from every peer.
+func startCluster(t *testing.T, n uint64, up uint64) ([]*protocol.Connection, *server.MemoryTransport) {
+	transport := server.NewMemoryTransport()
+	servers := make([]*protocol.Connection, n)
+	var i = uint64(0)
+	for i < n {
+		servers[i] = &protocol.Connection{Network: "memory", Address: "server-" + strconv.FormatUint(i, 10)}
+		i++
+	}
+
+	directory := t.TempDir()
+	i = uint64(0)
+	for i < up {
+		s := server.New(i, servers[i], servers, 1000)
+		s.Transport = transport
+		s.DataDirectory = filepath.Join(directory, strconv.FormatUint(i, 10))
+		go server.Start(s)
+		i++
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for _, c := range servers[:up] {
+		for {
+			conn, err := transport.Dial(c)
+			if err == nil {
+				conn.Close()
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("server %s did not start listening: %v", c.Address, err)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	return servers, transport
+}
+
+func openSession(t *testing.T, servers []*protocol.Connection, guarantees Guarantee, transport server.Transport) *Session {
+	s, err := Open(servers, guarantees, transport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// Every write goes to one server and the read after it to the next, which has
+// usually not heard of the write yet and must wait for it.
+func TestSessionReadYourWritesAcrossServers(t *testing.T) {
+	servers, transport := startCluster(t, 3, 3)
+	s := openSession(t, servers, ReadYourWrites|MonotonicReads, transport)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	key := []byte("k")
+	var i = uint64(0)
+	for i < 30 {
+		value := []byte(strconv.FormatUint(i, 10))
+		s.serverId = i % 3
+		err := s.Put(ctx, key, value)
+		if err != nil {
+			t.Fatalf("put %d: %v", i, err)
+		}
+
+		s.serverId = (i + 1) % 3
+		got, err := s.Get(ctx, key)
+		if err != nil {
+			t.Fatalf("get %d: %v", i, err)
+		}
+		if !bytes.Equal(got, value) {
+			t.Fatalf("read %q after writing %q", got, value)
+		}
+		i++
+	}
+}
+
+// Reads under monotonic reads never go back to an older value, whichever
+// server serves them.
+func TestSessionMonotonicReads(t *testing.T) {
+	servers, transport := startCluster(t, 3, 3)
+	writer := openSession(t, servers, Causal, transport)
+	reader := openSession(t, servers, MonotonicReads, transport)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	key := []byte("k")
+	var last = int64(-1)
+	var i = uint64(0)
+	for i < 60 {
+		if i%2 == 0 {
+			writer.serverId = i % 3
+			err := writer.Put(ctx, key, []byte(strconv.FormatUint(i, 10)))
+			if err != nil {
+				t.Fatalf("put %d: %v", i, err)
+			}
+		}
+
+		reader.serverId = (i * 7) % 3
+		got, err := reader.Get(ctx, key)
+		if err != nil {
+			t.Fatalf("get %d: %v", i, err)
+		}
+		if got != nil {
+			n, err := strconv.ParseInt(string(got), 10, 64)
+			if err != nil {
+				t.Fatalf("read unexpected value %q", got)
+			}
+			if n < last {
+				t.Fatalf("read %d after reading %d", n, last)
+			}
+			last = n
+		}
+		i++
+	}
+}
+
+// Writes to different servers reach every server, and all of them end up with
+// the same value for every key.
+func TestClusterConverges(t *testing.T) {
+	servers, transport := startCluster(t, 3, 3)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	sessions := make([]*Session, len(servers))
+	for i := range sessions {
+		sessions[i] = openSession(t, servers, Eventual, transport)
+		sessions[i].serverId = uint64(i)
+	}
+
+	var i = uint64(0)
+	for i < 90 {
+		key := []byte(strconv.FormatUint(i%5, 10))
+		err := sessions[i%3].Put(ctx, key, []byte(strconv.FormatUint(i, 10)))
+		if err != nil {
+			t.Fatalf("put %d: %v", i, err)
+		}
+		i++
+	}
+
+	for {
+		converged := true
+		var k = uint64(0)
+		for k < 5 && converged {
+			key := []byte(strconv.FormatUint(k, 10))
+			first, err := sessions[0].Get(ctx, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, s := range sessions[1:] {
+				got, err := s.Get(ctx, key)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if first == nil || !bytes.Equal(got, first) {
+					converged = false
+				}
+			}
+			k++
+		}
+		if converged {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatal("servers did not converge")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// A replica that is down when the session opens is left out, and a session
+// that starts at it moves on to one that is up.
+func TestOpenToleratesDownReplica(t *testing.T) {
+	servers, transport := startCluster(t, 3, 2)
+	s := openSession(t, servers, Causal, transport)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	s.serverId = 2
+	err := s.Put(ctx, []byte("k"), []byte("v"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.serverId == 2 {
+		t.Fatal("session stayed at a server it cannot reach")
+	}
+	got, err := s.Get(ctx, []byte("k"))
+	if err != nil || !bytes.Equal(got, []byte("v")) {
+		t.Fatalf("read %q, %v", got, err)
+	}
+
+	_, err = Open(servers[2:], Causal, transport)
+	if err == nil {
+		t.Fatal("opened a session with no reachable server")
+	}
+}
@@ -0,0 +1,154 @@
+package client
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math/rand/v2"
+	"os"
+)
+
+const (
+	OperationRead            = uint64(0)
+	OperationUpdate          = uint64(1)
+	OperationInsert          = uint64(2)
+	OperationScan            = uint64(3)
+	OperationReadModifyWrite = uint64(4)
+)
+
+var operationNames = []string{"read", "write", "insert", "scan", "read_modify_write"}
+
+// A WorkloadProfile describes a YCSB-style workload. The proportions are
+// relative weights of the operation types and need not add up to one. Before
+// the run, the threads load RecordCount records between them; inserts then add
+// new keys after the loaded ones. A scan reads up to MaxScanLength consecutive
+// keys one at a time, and a read-modify-write reads a key and then writes it.
+// Keys picks the key of every operation but inserts; when its Type is empty
+// the client's own key distribution is used, and when its Keys is zero it
+// covers the loaded records.
+type WorkloadProfile struct {
+	Name                      string
+	RecordCount               uint64
+	ValueSize                 uint64
+	ReadProportion            float64
+	UpdateProportion          float64
+	InsertProportion          float64
+	ScanProportion            float64
+	ReadModifyWriteProportion float64
+	MaxScanLength             uint64
+	Keys                      KeyDistribution
+}
+
+var ErrEmptyWorkload = errors.New("workload profile has no operations")
+
+func LoadWorkloadProfile(path string) (WorkloadProfile, error) {
+	var profile WorkloadProfile
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return profile, err
+	}
+	err = json.Unmarshal(b, &profile)
+	if err != nil {
+		return profile, err
+	}
+	if proportions(profile)[len(operationNames)-1] <= 0 {
+		return profile, ErrEmptyWorkload
+	}
+	return profile, nil
+}
+
+// Without a profile, Workload is the percentage of operations that are writes.
+func workloadProfile(config ConfigurationInfo) WorkloadProfile {
+	if proportions(config.Profile)[len(operationNames)-1] > 0 {
+		return config.Profile
+	}
+	return WorkloadProfile{
+		ReadProportion:   float64(100 - minTwoInts(config.Workload, 100)),
+		UpdateProportion: float64(minTwoInts(config.Workload, 100)),
+		Keys:             config.Keys,
+	}
+}
+
+func profileKeys(config ConfigurationInfo, profile WorkloadProfile) KeyDistribution {
+	keys := config.Keys
+	if profile.Keys.Type != "" {
+		keys = profile.Keys
+	}
+	if keys.Keys == 0 {
+		keys.Keys = profile.RecordCount
+	}
+	return keys
+}
+
+// The cumulative proportions, in the order of the operation types.
+func proportions(profile WorkloadProfile) []float64 {
+	weights := []float64{profile.ReadProportion, profile.UpdateProportion, profile.InsertProportion,
+		profile.ScanProportion, profile.ReadModifyWriteProportion}
+	var total = float64(0)
+	var i = uint64(0)
+	for i < uint64(len(weights)) {
+		total += weights[i]
+		weights[i] = total
+		i++
+	}
+	return weights
+}
+
+func chooseOperation(profile WorkloadProfile, r *rand.Rand) uint64 {
+	weights := proportions(profile)
+	x := r.Float64() * weights[len(weights)-1]
+	var i = uint64(0)
+	for i < uint64(len(weights))-1 {
+		if x < weights[i] {
+			return i
+		}
+		i++
+	}
+	return i
+}
+
+// A step is one request of an operation.
+type step struct {
+	operationType uint64
+	key           uint64
+}
+
+func operationSteps(profile WorkloadProfile, operation uint64, key uint64, records uint64, r *rand.Rand) []step {
+	switch operation {
+	case OperationUpdate, OperationInsert:
+		return []step{{operationType: 1, key: key}}
+	case OperationReadModifyWrite:
+		return []step{{operationType: 0, key: key}, {operationType: 1, key: key}}
+	case OperationScan:
+		length := profile.MaxScanLength
+		if length == 0 {
+			length = 100
+		}
+		length = 1 + r.Uint64N(length)
+		var steps = make([]step, 0, length)
+		var i = uint64(0)
+		for i < length && key+i < maxTwoInts(records, key+1) {
+			steps = append(steps, step{operationType: 0, key: key + i})
+			i++
+		}
+		return steps
+	}
+	return []step{{operationType: 0, key: key}}
+}
+
+// Values start with the client id and a per-client sequence number, so every
+// write is distinguishable in the history, and are padded out to ValueSize.
+func operationValue(profile WorkloadProfile, id uint64, sequence uint64) []byte {
+	v := binary.BigEndian.AppendUint64(binary.BigEndian.AppendUint64(nil, id), sequence)
+	for uint64(len(v)) < profile.ValueSize {
+		v = append(v, 0)
+	}
+	return v
+}
+
+func minTwoInts(x uint64, y uint64) uint64 {
+	if x < y {
+		return x
+	}
+	return y
+}
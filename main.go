@@ -2,18 +2,21 @@ package main
 
 import (
 	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
-	"runtime/debug"
 	// "runtime/pprof"
-	// "time"
+	"time"
 
+	"github.com/alanwang67/session_semantics/checker"
 	"github.com/alanwang67/session_semantics/client"
 	"github.com/alanwang67/session_semantics/protocol"
 	"github.com/alanwang67/session_semantics/server"
+	"github.com/alanwang67/session_semantics/simulator"
 )
 
 func processAddressString(address string, n uint64) string {
@@ -22,10 +25,37 @@ func processAddressString(address string, n uint64) string {
 	return l[0] + ":" + (strconv.Itoa(int(i + n)))
 }
 
-func main() {
-	debug.SetGCPercent(-1)
-	// fmt.Println("We have disabled the GC!")
+func parseUnsatisfiedPolicy(policy string) uint64 {
+	switch policy {
+	case "park":
+		return server.UnsatisfiedPark
+	case "forward":
+		return server.UnsatisfiedForward
+	case "reject":
+		return server.UnsatisfiedReject
+	}
+	log.Fatalf("unknown unsatisfied request policy: %s", policy)
+	return 0
+}
+
+func reportViolations(violations []checker.Violation) bool {
+	guarantees := []string{checker.ReadYourWrites, checker.MonotonicReads, checker.WritesFollowReads, checker.MonotonicWrites, checker.Causal}
+	for _, g := range guarantees {
+		count := 0
+		for _, v := range violations {
+			if v.Guarantee == g {
+				if count < 10 {
+					fmt.Println(v)
+				}
+				count++
+			}
+		}
+		fmt.Println(g+"_violations:", count)
+	}
+	return len(violations) != 0
+}
 
+func main() {
 	// f, _ := os.Create("cpu.pprof" + os.Args[2] + os.Args[3])
 
 	// pprof.StartCPUProfile(f)
@@ -52,6 +82,22 @@ func main() {
 		}
 	}
 
+	var transport server.Transport = server.TCPTransport{}
+	if data["Faults"] != nil {
+		var faults server.FaultConfig
+		b, _ := json.Marshal(data["Faults"])
+		err := json.Unmarshal(b, &faults)
+		if err != nil {
+			log.Fatalf("invalid fault configuration: %v", err)
+		}
+
+		self := "client"
+		if os.Args[2] == "server" && len(os.Args) > 3 {
+			self = os.Args[3]
+		}
+		transport = server.NewFaultyTransport(server.TCPTransport{}, faults, self, servers)
+	}
+
 	switch os.Args[2] {
 	case "client":
 		fileLocation := os.Args[3]
@@ -62,17 +108,63 @@ func main() {
 
 		threads, _ := strconv.ParseUint(os.Args[4], 10, 64)
 		time, _ := strconv.ParseUint(os.Args[5], 10, 64)
-		sessionSemantic, _ := strconv.ParseUint(os.Args[6], 10, 64)
-		workload, _ := strconv.ParseUint(os.Args[7], 10, 64)
+		guarantees, err := client.ParseGuarantee(os.Args[6])
+		if err != nil {
+			log.Fatalf("invalid session semantic %q: %v", os.Args[6], err)
+		}
+		// The workload is either a write percentage or a workload profile file.
+		workload, err := strconv.ParseUint(os.Args[7], 10, 64)
+		var profile client.WorkloadProfile
+		if err != nil {
+			profile, err = client.LoadWorkloadProfile(os.Args[7])
+			if err != nil {
+				log.Fatalf("invalid workload %q: %v", os.Args[7], err)
+			}
+		}
 		switchServer := uint64(data["SwitchServer"].(float64))
 		primaryBackUpRoundRobin := data["PrimaryBackUpRoundRobin"].(bool)
 		primaryBackupRandom := data["PrimaryBackupRandom"].(bool)
 		gossipRandom := data["GossipRandom"].(bool)
 		pinnedRoundRobin := data["PinnedRoundRobin"].(bool)
 
+		timeout := uint64(0)
+		if data["Timeout"] != nil {
+			timeout = uint64(data["Timeout"].(float64))
+		}
+
+		failoverWait := uint64(0)
+		if data["FailoverWait"] != nil {
+			failoverWait = uint64(data["FailoverWait"].(float64))
+		}
+		reject := false
+		if data["Reject"] != nil {
+			reject = data["Reject"].(bool)
+		}
+
+		sampleInterval := uint64(0)
+		if data["SampleInterval"] != nil {
+			sampleInterval = uint64(data["SampleInterval"].(float64))
+		}
+
+		var keys client.KeyDistribution
+		if data["KeyDistribution"] != nil {
+			b, _ := json.Marshal(data["KeyDistribution"])
+			err := json.Unmarshal(b, &keys)
+			if err != nil {
+				log.Fatalf("invalid key distribution: %v", err)
+			}
+		}
+
+		// The history and results files are optional and named by flags after
+		// the workload.
+		flags := flag.NewFlagSet("client", flag.ExitOnError)
+		historyFile := flags.String("history", "", "write the history of every session to this file")
+		resultsFile := flags.String("results", "", "write the results as JSON and CSV to this file")
+		flags.Parse(os.Args[8:])
+
 		conf := client.ConfigurationInfo{
 			Threads:                 threads,
-			SessionSemantic:         sessionSemantic,
+			Guarantees:              guarantees,
 			Time:                    time,
 			SwitchServer:            switchServer,
 			Workload:                workload,
@@ -80,9 +172,17 @@ func main() {
 			PrimaryBackupRandom:     primaryBackupRandom,
 			GossipRandom:            gossipRandom,
 			PinnedRoundRobin:        pinnedRoundRobin,
+			HistoryFile:             *historyFile,
+			ResultsFile:             *resultsFile,
+			SampleInterval:          sampleInterval,
+			Keys:                    keys,
+			Profile:                 profile,
+			Timeout:                 timeout,
+			FailoverWait:            failoverWait,
+			Reject:                  reject,
 		}
 		fmt.Printf("%+v\n", conf)
-		client.Start(conf, servers)
+		client.Start(conf, servers, transport)
 	case "server":
 		if len(os.Args) < 4 {
 			log.Fatalf("usage: go run main.go _ server [id] [gossip_interval]")
@@ -93,7 +193,80 @@ func main() {
 		gossipInterval, _ := strconv.ParseUint(os.Args[4], 10, 64)
 
 		// go func() {
-		server.Start(server.New(id, servers[id], servers, gossipInterval))
+		s := server.New(id, servers[id], servers, gossipInterval)
+		s.Transport = transport
+		if maxKeySize, ok := data["MaxKeySize"].(float64); ok {
+			s.MaxKeySize = uint64(maxKeySize)
+		}
+		if maxValueSize, ok := data["MaxValueSize"].(float64); ok {
+			s.MaxValueSize = uint64(maxValueSize)
+		}
+		if gossipRetransmitTicks, ok := data["GossipRetransmitTicks"].(float64); ok {
+			s.GossipRetransmitTicks = uint64(gossipRetransmitTicks)
+		}
+		if snapshotThreshold, ok := data["SnapshotThreshold"].(float64); ok {
+			s.SnapshotThreshold = uint64(snapshotThreshold)
+		}
+		if dataDirectory, ok := data["DataDirectory"].(string); ok {
+			s.DataDirectory = filepath.Join(dataDirectory, "server-"+strconv.FormatUint(id, 10))
+		}
+		if syncPolicy, ok := data["SyncPolicy"].(string); ok {
+			switch syncPolicy {
+			case "per-op":
+				s.SyncPolicy = server.SyncPerOperation
+			case "batched":
+				s.SyncPolicy = server.SyncBatched
+			case "none":
+				s.SyncPolicy = server.SyncNone
+			default:
+				log.Fatalf("unknown sync policy: %s", syncPolicy)
+			}
+		}
+		if policy, ok := data["UnsatisfiedPolicy"].(string); ok {
+			s.UnsatisfiedPolicy = parseUnsatisfiedPolicy(policy)
+		}
+		if forwardTimeout, ok := data["ForwardTimeout"].(float64); ok {
+			s.ForwardTimeout = uint64(forwardTimeout)
+		}
+		if data["Topology"] != nil {
+			var topology server.Topology
+			b, _ := json.Marshal(data["Topology"])
+			err := json.Unmarshal(b, &topology)
+			if err != nil {
+				log.Fatalf("invalid topology: %v", err)
+			}
+			s.Neighbours, err = server.Neighbours(topology, id, uint64(len(servers)))
+			if err != nil {
+				log.Fatalf("invalid topology %q: %v", topology.Type, err)
+			}
+			s.Relay = topology.Type != "" && topology.Type != "full"
+			s.GossipFanout = topology.Fanout
+		}
+		if gossipJitter, ok := data["GossipJitter"].(float64); ok {
+			s.GossipJitter = uint64(gossipJitter)
+		}
+		if gossipMinInterval, ok := data["GossipMinInterval"].(float64); ok {
+			s.GossipMinInterval = uint64(gossipMinInterval)
+		}
+		if gossipMaxInterval, ok := data["GossipMaxInterval"].(float64); ok {
+			s.GossipMaxInterval = uint64(gossipMaxInterval)
+		}
+		if gossipMaxOperations, ok := data["GossipMaxOperations"].(float64); ok {
+			s.GossipMaxOperations = uint64(gossipMaxOperations)
+		}
+		if gossipMaxBytes, ok := data["GossipMaxBytes"].(float64); ok {
+			s.GossipMaxBytes = uint64(gossipMaxBytes)
+		}
+		if antiEntropyInterval, ok := data["AntiEntropyInterval"].(float64); ok {
+			s.AntiEntropyInterval = uint64(antiEntropyInterval)
+		}
+		if syncInterval, ok := data["SyncInterval"].(float64); ok {
+			s.SyncInterval = uint64(syncInterval)
+		}
+		if snapshotInterval, ok := data["SnapshotInterval"].(float64); ok {
+			s.SnapshotInterval = uint64(snapshotInterval)
+		}
+		server.Start(s)
 		// }()
 
 		// time.Sleep(60 * time.Second)
@@ -107,6 +280,79 @@ func main() {
 
 		// pprof.StopCPUProfile()
 		// server.Start(server.New(id, servers[id], servers, gossipInterval))
+	case "simulate":
+		if len(os.Args) < 8 {
+			log.Fatalf("usage: go run main.go _ simulate [seed] [clients] [operations] [session_semantic] [workload] [unsatisfied_policy]")
+		}
+
+		seed, _ := strconv.ParseUint(os.Args[3], 10, 64)
+		clients, _ := strconv.ParseUint(os.Args[4], 10, 64)
+		operations, _ := strconv.ParseUint(os.Args[5], 10, 64)
+		guarantees, err := client.ParseGuarantee(os.Args[6])
+		if err != nil {
+			log.Fatalf("invalid session semantic %q: %v", os.Args[6], err)
+		}
+		workload, _ := strconv.ParseUint(os.Args[7], 10, 64)
+
+		// The rest of the run is configured by the optional "Simulator" object.
+		simulatorConfig := simulator.Config{
+			Keys:                10,
+			SwitchServer:        10,
+			GossipInterval:      1000,
+			GossipJitter:        500,
+			MinDelay:            50,
+			MaxDelay:            500,
+			MaxTime:             uint64(time.Hour / time.Microsecond),
+			UnsatisfiedPolicy:   server.UnsatisfiedPark,
+			AntiEntropyInterval: 20000,
+		}
+		if data["Simulator"] != nil {
+			b, _ := json.Marshal(data["Simulator"])
+			err := json.Unmarshal(b, &simulatorConfig)
+			if err != nil {
+				log.Fatalf("invalid simulator configuration: %v", err)
+			}
+		}
+		simulatorConfig.Seed = seed
+		simulatorConfig.Servers = uint64(len(servers))
+		simulatorConfig.Clients = clients
+		simulatorConfig.Operations = operations
+		simulatorConfig.Guarantees = guarantees
+		simulatorConfig.Workload = workload
+		simulatorConfig.History = true
+		if len(os.Args) > 8 {
+			simulatorConfig.UnsatisfiedPolicy = parseUnsatisfiedPolicy(os.Args[8])
+		}
+
+		result := simulator.Run(simulatorConfig)
+		fmt.Println("seed:", result.Seed)
+		fmt.Println("simulated_time:", result.Time, "us")
+		fmt.Println("completed_operations:", result.Completed)
+		fmt.Println("failed_operations:", result.Failed)
+		fmt.Println("converged:", result.Converged)
+		for _, s := range result.Servers {
+			fmt.Println("server", s.Id, "vector_clock:", s.VectorClock)
+		}
+		reportViolations(checker.Check(result.History))
+	case "check":
+		if len(os.Args) < 4 {
+			log.Fatalf("usage: go run main.go _ check [history_file]")
+		}
+
+		f, err := os.Open(os.Args[3])
+		if err != nil {
+			log.Fatal(err)
+		}
+		history, err := checker.ReadHistory(f)
+		f.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		fmt.Println("operations:", len(history))
+		if reportViolations(checker.Check(history)) {
+			os.Exit(1)
+		}
 	default:
 		log.Fatalf("unknown command: %s", os.Args[1])
 	}
@@ -0,0 +1,325 @@
+package server
+
+import (
+	"math"
+	"math/rand/v2"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/alanwang67/session_semantics/protocol"
+)
+
+// Nodes are named by server id ("0", "1", ...) or "client", and "*" matches
+// any node. Latencies are in microseconds and partition times in milliseconds
+// since the fault configuration's Epoch.
+type LinkFaults struct {
+	From                string
+	To                  string
+	Drop                float64
+	Duplicate           float64
+	Reorder             float64
+	LatencyDistribution string
+	Latency             float64
+	LatencyJitter       float64
+}
+
+type Partition struct {
+	Start  uint64
+	End    uint64
+	Groups [][]string
+}
+
+// Epoch is a wall-clock time in milliseconds since the Unix epoch, so that
+// every process measures partitions from the same moment however late it
+// starts. Zero measures them from when each transport was created.
+type FaultConfig struct {
+	Seed       uint64
+	Epoch      int64
+	Links      []LinkFaults
+	Partitions []Partition
+}
+
+// FaultyTransport injects faults into everything sent over the transport it
+// wraps. Connections it dials lead to the peer with the matching address;
+// connections it accepts are only ever used to reply to clients.
+type FaultyTransport struct {
+	Inner  Transport
+	Config FaultConfig
+	Self   string
+	Peers  []*protocol.Connection
+	start  time.Time
+	r      *rand.Rand
+	mu     sync.Mutex
+}
+
+type faultyListener struct {
+	l Listener
+	t *FaultyTransport
+}
+
+type delayedMessage struct {
+	at time.Time
+	m  Message
+}
+
+type faultyConn struct {
+	c      Conn
+	t      *FaultyTransport
+	from   string
+	to     string
+	queue  chan delayedMessage
+	closed chan struct{}
+	once   sync.Once
+	err    error
+	mu     sync.Mutex
+}
+
+func NewFaultyTransport(inner Transport, config FaultConfig, self string, peers []*protocol.Connection) *FaultyTransport {
+	start := time.Now()
+	if config.Epoch != 0 {
+		start = time.UnixMilli(config.Epoch)
+	}
+	return &FaultyTransport{
+		Inner:  inner,
+		Config: config,
+		Self:   self,
+		Peers:  peers,
+		start:  start,
+		r:      rand.New(rand.NewPCG(config.Seed, config.Seed+1)),
+	}
+}
+
+func (t *FaultyTransport) name(c *protocol.Connection) string {
+	var i = uint64(0)
+	for i < uint64(len(t.Peers)) {
+		if t.Peers[i].Network == c.Network && t.Peers[i].Address == c.Address {
+			return strconv.FormatUint(i, 10)
+		}
+		i++
+	}
+	return c.Address
+}
+
+func (t *FaultyTransport) wrap(c Conn, to string) Conn {
+	fc := &faultyConn{c: c, t: t, from: t.Self, to: to, queue: make(chan delayedMessage, 1024), closed: make(chan struct{})}
+	go fc.deliver()
+	return fc
+}
+
+func (t *FaultyTransport) Listen(c *protocol.Connection) (Listener, error) {
+	l, err := t.Inner.Listen(c)
+	if err != nil {
+		return nil, err
+	}
+	return &faultyListener{l: l, t: t}, nil
+}
+
+func (t *FaultyTransport) Dial(c *protocol.Connection) (Conn, error) {
+	conn, err := t.Inner.Dial(c)
+	if err != nil {
+		return nil, err
+	}
+	return t.wrap(conn, t.name(c)), nil
+}
+
+func (l *faultyListener) Accept() (Conn, error) {
+	c, err := l.l.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return l.t.wrap(c, "client"), nil
+}
+
+func (l *faultyListener) Close() error {
+	return l.l.Close()
+}
+
+func matchNode(pattern string, node string) bool {
+	return pattern == "*" || pattern == node
+}
+
+func (t *FaultyTransport) link(from string, to string) LinkFaults {
+	var i = uint64(0)
+	for i < uint64(len(t.Config.Links)) {
+		if matchNode(t.Config.Links[i].From, from) && matchNode(t.Config.Links[i].To, to) {
+			return t.Config.Links[i]
+		}
+		i++
+	}
+	return LinkFaults{}
+}
+
+func partitionGroup(p Partition, node string) int {
+	for i, group := range p.Groups {
+		for _, n := range group {
+			if n == node {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// Nodes that are not in any group of an active partition can still reach
+// every other node.
+func (t *FaultyTransport) partitioned(from string, to string) bool {
+	since := time.Since(t.start).Milliseconds()
+	if since < 0 {
+		return false
+	}
+	elapsed := uint64(since)
+	for _, p := range t.Config.Partitions {
+		if elapsed < p.Start || (p.End != 0 && elapsed >= p.End) {
+			continue
+		}
+		g1 := partitionGroup(p, from)
+		g2 := partitionGroup(p, to)
+		if g1 != -1 && g2 != -1 && g1 != g2 {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *FaultyTransport) chance(p float64) bool {
+	if p <= 0 {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.r.Float64() < p
+}
+
+func (t *FaultyTransport) latency(l LinkFaults) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var us float64
+	switch l.LatencyDistribution {
+	case "uniform":
+		us = l.Latency - l.LatencyJitter + 2*l.LatencyJitter*t.r.Float64()
+	case "exponential":
+		us = l.Latency * t.r.ExpFloat64()
+	case "normal":
+		us = l.Latency + l.LatencyJitter*t.r.NormFloat64()
+	default:
+		us = l.Latency
+	}
+	return time.Duration(math.Max(us, 0)) * time.Microsecond
+}
+
+// A delayed message is sent after Send has returned, so an error sending it
+// is kept and returned by the next Send instead, which lets the caller notice
+// the broken connection and dial again.
+func (c *faultyConn) fail(err error) {
+	if err == nil {
+		return
+	}
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	c.mu.Unlock()
+}
+
+func (c *faultyConn) failed() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// Delayed messages wait in a queue, so they are delivered in order unless
+// they are picked for reordering, in which case they are held back for
+// another latency plus a millisecond so that later messages overtake them.
+func (c *faultyConn) Send(m *Message) error {
+	select {
+	case <-c.closed:
+		return net.ErrClosed
+	default:
+	}
+	err := c.failed()
+	if err != nil {
+		return err
+	}
+	if c.t.partitioned(c.from, c.to) {
+		return nil
+	}
+
+	l := c.t.link(c.from, c.to)
+	if c.t.chance(l.Drop) {
+		return nil
+	}
+
+	copies := 1
+	if c.t.chance(l.Duplicate) {
+		copies = 2
+	}
+
+	for copies > 0 {
+		copies--
+		at := time.Now().Add(c.t.latency(l))
+		if c.t.chance(l.Reorder) {
+			at = at.Add(c.t.latency(l) + time.Duration(l.LatencyJitter)*time.Microsecond + time.Millisecond)
+			go func(d delayedMessage) {
+				if c.wait(d.at) {
+					c.fail(c.c.Send(&d.m))
+				}
+			}(delayedMessage{at: at, m: *m})
+			continue
+		}
+
+		if l.Latency == 0 && l.LatencyJitter == 0 {
+			err := c.c.Send(m)
+			if err != nil {
+				c.fail(err)
+				return err
+			}
+			continue
+		}
+		select {
+		case c.queue <- delayedMessage{at: at, m: *m}:
+		case <-c.closed:
+			return net.ErrClosed
+		}
+	}
+	return nil
+}
+
+// wait sleeps until at and reports whether the connection is still open.
+func (c *faultyConn) wait(at time.Time) bool {
+	timer := time.NewTimer(time.Until(at))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-c.closed:
+		return false
+	}
+}
+
+func (c *faultyConn) deliver() {
+	for {
+		select {
+		case d := <-c.queue:
+			if !c.wait(d.at) {
+				return
+			}
+			c.fail(c.c.Send(&d.m))
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+func (c *faultyConn) Receive(m *Message) error {
+	return c.c.Receive(m)
+}
+
+// Closing drops the messages still waiting in the delay queue and stops the
+// goroutine that delivers them.
+func (c *faultyConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return c.c.Close()
+}
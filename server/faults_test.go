@@ -0,0 +1,112 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/alanwang67/session_semantics/protocol"
+)
+
+func TestPartitionsStartAtEpoch(t *testing.T) {
+	config := FaultConfig{Partitions: []Partition{{Start: 4000, End: 6000, Groups: [][]string{{"0"}, {"1", "2"}}}}}
+
+	fresh := NewFaultyTransport(nil, config, "0", nil)
+	if fresh.partitioned("0", "1") {
+		t.Fatal("partition started as soon as the transport was created")
+	}
+
+	config.Epoch = time.Now().Add(-5 * time.Second).UnixMilli()
+	late := NewFaultyTransport(nil, config, "0", nil)
+	if !late.partitioned("0", "1") || !late.partitioned("2", "0") {
+		t.Fatal("a transport created during the partition is not partitioned")
+	}
+	if late.partitioned("1", "2") || late.partitioned("0", "client") {
+		t.Fatal("nodes on the same side of the partition are partitioned")
+	}
+
+	config.Epoch = time.Now().Add(5 * time.Second).UnixMilli()
+	early := NewFaultyTransport(nil, config, "0", nil)
+	if early.partitioned("0", "1") {
+		t.Fatal("partition started before its epoch")
+	}
+}
+
+func TestClosedConnectionDropsDelayedMessages(t *testing.T) {
+	inner := NewMemoryTransport()
+	address := &protocol.Connection{Network: "memory", Address: "server-0"}
+	l, err := inner.Listen(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	config := FaultConfig{Links: []LinkFaults{{From: "*", To: "*", Latency: 50000}}}
+	transport := NewFaultyTransport(inner, config, "client", []*protocol.Connection{address})
+	c, err := transport.Dial(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.Send(&Message{MessageType: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	err = c.Send(&Message{MessageType: 0})
+	if !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("send on a closed connection returned %v", err)
+	}
+
+	var m = Message{}
+	err = accepted.Receive(&m)
+	if err == nil {
+		t.Fatal("a delayed message was delivered after the connection was closed")
+	}
+}
+
+// A delayed message that cannot be sent because the peer went away makes the
+// next send fail, so the sender knows to dial again.
+func TestDelayedSendErrorIsReturnedByNextSend(t *testing.T) {
+	inner := NewMemoryTransport()
+	address := &protocol.Connection{Network: "memory", Address: "server-0"}
+	l, err := inner.Listen(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	config := FaultConfig{Links: []LinkFaults{{From: "*", To: "*", Latency: 1000}}}
+	transport := NewFaultyTransport(inner, config, "0", []*protocol.Connection{address})
+	c, err := transport.Dial(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	accepted, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted.Close()
+
+	err = c.Send(&Message{MessageType: 1})
+	if err != nil {
+		t.Fatalf("a delayed send returned %v before the message was sent", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		time.Sleep(5 * time.Millisecond)
+		err = c.Send(&Message{MessageType: 1})
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("sends to a closed peer still return %v", err)
+		}
+	}
+}
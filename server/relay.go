@@ -0,0 +1,178 @@
+package server
+
+// In relay mode a server gossips every operation it has applied, from any
+// origin, to its neighbours in the topology, so operations reach servers that
+// their origin never talks to. What a neighbour has is tracked as its vector
+// clock rather than as an index into MyOperations: the clock it last
+// acknowledged, and the clock of what has been sent to it since.
+
+func copyVectorClocks(clocks [][]uint64) [][]uint64 {
+	var out = make([][]uint64, len(clocks))
+	var i = uint64(0)
+	for i < uint64(len(clocks)) {
+		if clocks[i] != nil {
+			out[i] = append([]uint64(nil), clocks[i]...)
+		}
+		i++
+	}
+	return out
+}
+
+func minTS(t1 []uint64, t2 []uint64) []uint64 {
+	var i = uint64(0)
+	var output = make([]uint64, len(t1))
+	for i < uint64(len(t1)) {
+		output[i] = t1[i]
+		if t2[i] < output[i] {
+			output[i] = t2[i]
+		}
+		i++
+	}
+	return output
+}
+
+// Every server passes on the clocks it knows of, so a server learns the
+// clocks of servers it never hears from directly.
+func mergePeerVectorClocks(server Server, request Message) Server {
+	var i = uint64(0)
+	for i < uint64(len(request.S2S_Gossip_PeerVectorClocks)) {
+		server = observePeerVectorClock(server, i, request.S2S_Gossip_PeerVectorClocks[i])
+		i++
+	}
+	return server
+}
+
+// A neighbour's acknowledgement carries its whole clock. Acknowledgements may
+// arrive out of order, and the known clock also advances through gossip and
+// through clocks learned from other servers, so an acknowledgement behind it
+// is just stale; a restarted neighbour is noticed through its epoch.
+func acknowledgeRelayGossip(server Server, request Message) Server {
+	peer := request.S2S_Acknowledge_Gossip_Sending_ServerId
+	vectorClock := request.S2S_Acknowledge_Gossip_VectorClock
+	if peer >= server.NumberOfServers || peer == server.Id || uint64(len(vectorClock)) != server.NumberOfServers {
+		return server
+	}
+
+	known := server.PeerVectorClocks[peer]
+	if known == nil || !compareVersionVector(known, vectorClock) {
+		server.GossipUnackedTicks[peer] = 0
+	}
+	return observePeerVectorClock(server, peer, vectorClock)
+}
+
+// An operation is stable once every server's known clock covers it.
+func updateRelayStableVersionVector(server Server) Server {
+	var stable = append([]uint64(nil), server.VectorClock...)
+	var i = uint64(0)
+	for i < server.NumberOfServers {
+		if i != server.Id {
+			if server.PeerVectorClocks[i] == nil {
+				return server
+			}
+			stable = minTS(stable, server.PeerVectorClocks[i])
+		}
+		i++
+	}
+
+	server.StableVersionVector = maxTS(server.StableVersionVector, stable)
+	return server
+}
+
+func getRelayGossipOperations(server Server, base []uint64) []Operation {
+	var operations = make([]Operation, 0)
+	var i = uint64(0)
+	for i < uint64(len(server.OperationsPerformed)) {
+		if !compareVersionVector(base, server.OperationsPerformed[i].VersionVector) {
+			operations = append(operations, server.OperationsPerformed[i])
+		}
+		i++
+	}
+	return operations
+}
+
+// On a tick, a neighbour that has not acknowledged what it was sent within
+// GossipRetransmitTicks ticks is sent it again. Without a tick, the next chunk
+// of a backlog is only sent once everything before it is acknowledged.
+func relayGossipTo(server Server, peer uint64, announce bool, tick bool) (Server, []Message) {
+	var outGoingRequests = make([]Message, 0)
+
+	known := server.PeerVectorClocks[peer]
+	if known == nil {
+		known = make([]uint64, server.NumberOfServers)
+	}
+	sent := server.GossipSentVectors[peer]
+	if sent == nil {
+		sent = known
+	}
+
+	var operations = make([]Operation, 0)
+	if compareVersionVector(known, server.VectorClock) {
+		server.GossipUnackedTicks[peer] = 0
+		server.GossipStreaming[peer] = false
+	} else if tick || compareVersionVector(known, sent) {
+		if tick && !compareVersionVector(known, sent) {
+			server.GossipUnackedTicks[peer] += 1
+			if server.GossipUnackedTicks[peer] >= server.GossipRetransmitTicks {
+				server.GossipUnackedTicks[peer] = 0
+				sent = known
+			}
+		}
+
+		// Operations that were compacted away or came in a snapshot are not in
+		// OperationsPerformed, so a neighbour that may be missing some of them
+		// needs a snapshot.
+		base := maxTS(sent, known)
+		server.GossipSentVectors = append([][]uint64(nil), server.GossipSentVectors...)
+		if !compareVersionVector(base, getLoggedVersionVector(server)) {
+			outGoingRequests = append(outGoingRequests, getSnapshotMessages(server, peer)...)
+			server.GossipSentVectors[peer] = append([]uint64(nil), server.VectorClock...)
+			server.GossipStreaming[peer] = false
+		} else if !compareVersionVector(base, server.VectorClock) {
+			// Operations are in lexicographic order, so a prefix of them is closed
+			// under causality and what has been sent is again a vector clock.
+			var truncated = false
+			operations, truncated = limitGossipOperations(server, getRelayGossipOperations(server, base))
+			for _, operation := range operations {
+				base = maxTS(base, operation.VersionVector)
+			}
+			server.GossipSentOperations += uint64(len(operations))
+			server.GossipSentVectors[peer] = base
+			server.GossipStreaming[peer] = truncated
+		}
+	}
+
+	if uint64(len(operations)) != uint64(0) || announce {
+		outGoingRequests = append(outGoingRequests,
+			Message{MessageType: 1,
+				S2S_Gossip_Sending_ServerId:    server.Id,
+				S2S_Gossip_Receiving_ServerId:  peer,
+				S2S_Gossip_Operations:          operations,
+				S2S_Gossip_Index:               server.MyOperationsOffset + uint64(len(server.MyOperations)),
+				S2S_Gossip_StableVersionVector: append([]uint64(nil), server.StableVersionVector...),
+				S2S_Gossip_VectorClock:         append([]uint64(nil), server.VectorClock...),
+				S2S_Gossip_Epoch:               server.Epoch,
+				S2S_Gossip_PeerVectorClocks:    copyVectorClocks(server.PeerVectorClocks),
+			})
+	}
+	return server, outGoingRequests
+}
+
+func relayGossip(server Server, targets []uint64) (Server, []Message) {
+	var outGoingRequests = make([]Message, 0)
+
+	server = updateRelayStableVersionVector(server)
+	announce := !equalSlices(server.StableVersionVector, server.AnnouncedStableVector)
+	server.GossipSentOperations = 0
+
+	for _, peer := range targets {
+		if peer >= server.NumberOfServers || peer == server.Id {
+			continue
+		}
+		var messages []Message
+		server, messages = relayGossipTo(server, peer, announce, true)
+		outGoingRequests = append(outGoingRequests, messages...)
+	}
+
+	server.AnnouncedStableVector = append([]uint64(nil), server.StableVersionVector...)
+	return compactOperations(server), outGoingRequests
+}
@@ -1,19 +1,98 @@
 package server
 
 import (
-	"encoding/gob"
+	"bytes"
+	"errors"
 	"fmt"
 	"math/rand/v2"
-	"net"
 	"sync"
 	"time"
 
 	"github.com/alanwang67/session_semantics/protocol"
 )
 
+const (
+	DefaultMaxKeySize            = uint64(1 << 10)
+	DefaultMaxValueSize          = uint64(1 << 20)
+	DefaultGossipRetransmitTicks = uint64(10)
+	DefaultSyncInterval          = uint64(10)
+	DefaultSnapshotInterval      = uint64(60000)
+	DefaultSnapshotThreshold     = uint64(100000)
+	DefaultAntiEntropyInterval   = uint64(1000)
+	DefaultGossipJitter          = uint64(500)
+	DefaultGossipMaxOperations   = uint64(4096)
+	DefaultGossipMaxBytes        = uint64(4 << 20)
+	DefaultForwardTimeout        = uint64(100000)
+)
+
+// What a server does with a client request whose dependencies it has not
+// reached yet.
+const (
+	UnsatisfiedPark    = uint64(0)
+	UnsatisfiedForward = uint64(1)
+	UnsatisfiedReject  = uint64(2)
+)
+
+const (
+	StatusOk            = uint64(0)
+	StatusKeyTooLarge   = uint64(1)
+	StatusValueTooLarge = uint64(2)
+	StatusUnsatisfied   = uint64(3)
+	StatusCancelled     = uint64(4)
+	StatusBadVector     = uint64(5)
+)
+
+var (
+	ErrKeyTooLarge   = errors.New("key exceeds the server's maximum key size")
+	ErrValueTooLarge = errors.New("value exceeds the server's maximum value size")
+	ErrUnsatisfied   = errors.New("server has not yet seen the request's dependencies")
+	ErrCancelled     = errors.New("request was cancelled before the server served it")
+	ErrBadVector     = errors.New("request's version vector does not match the number of servers")
+)
+
+func StatusError(status uint64) error {
+	switch status {
+	case StatusOk:
+		return nil
+	case StatusKeyTooLarge:
+		return ErrKeyTooLarge
+	case StatusValueTooLarge:
+		return ErrValueTooLarge
+	case StatusUnsatisfied:
+		return ErrUnsatisfied
+	case StatusCancelled:
+		return ErrCancelled
+	case StatusBadVector:
+		return ErrBadVector
+	default:
+		return fmt.Errorf("unknown reply status %d", status)
+	}
+}
+
 type Operation struct {
 	VersionVector []uint64
-	Data          uint64
+	Key           []byte
+	Data          []byte
+}
+
+// A PendingSnapshot collects the chunks of a snapshot from one peer until all
+// of them have arrived.
+type PendingSnapshot struct {
+	VersionVector []uint64
+	Operations    []Operation
+	Received      []bool
+}
+
+// A ForwardedRequest is a client request this server passed on to a peer,
+// as the forwarded message it last sent, at SentTime.
+type ForwardedRequest struct {
+	Request  Message
+	SentTime uint64
+}
+
+type LogRecord struct {
+	Own       bool
+	Operation Operation
 }
 
 type Message struct {
@@ -22,52 +101,158 @@ type Message struct {
 	C2S_Client_Id            uint64
 	C2S_Server_Id            uint64
 	C2S_Client_OperationType uint64
-	C2S_Client_Data          uint64
+	C2S_Client_Key           []byte
+	C2S_Client_Data          []byte
 	C2S_Client_VersionVector []uint64
-
-	S2S_Gossip_Sending_ServerId   uint64
-	S2S_Gossip_Receiving_ServerId uint64
-	S2S_Gossip_Operations         []Operation
-	S2S_Gossip_Index              uint64
+	C2S_Client_RequestId     uint64
+	C2S_Client_Reject        bool
+	C2S_Client_ReceivedTime  uint64
+
+	S2S_Gossip_Sending_ServerId    uint64
+	S2S_Gossip_Receiving_ServerId  uint64
+	S2S_Gossip_Operations          []Operation
+	S2S_Gossip_Index               uint64
+	S2S_Gossip_StableVersionVector []uint64
+	S2S_Gossip_VectorClock         []uint64
+	S2S_Gossip_PeerVectorClocks    [][]uint64
+	S2S_Gossip_Targets             []uint64
+	S2S_Gossip_Epoch               uint64
 
 	S2S_Acknowledge_Gossip_Sending_ServerId   uint64
 	S2S_Acknowledge_Gossip_Receiving_ServerId uint64
 	S2S_Acknowledge_Gossip_Index              uint64
+	S2S_Acknowledge_Gossip_VectorClock        []uint64
+	S2S_Acknowledge_Gossip_Epoch              uint64
+	S2S_Acknowledge_Gossip_Recovering         bool
+
+	S2S_Snapshot_Sending_ServerId   uint64
+	S2S_Snapshot_Receiving_ServerId uint64
+	S2S_Snapshot_Operations         []Operation
+	S2S_Snapshot_VersionVector      []uint64
+	S2S_Snapshot_Chunk              uint64
+	S2S_Snapshot_Chunks             uint64
+
+	S2S_Forward_Sending_ServerId   uint64
+	S2S_Forward_Receiving_ServerId uint64
+	S2S_Forward_VectorClock        []uint64
+
+	S2S_AntiEntropy_Sending_ServerId   uint64
+	S2S_AntiEntropy_Receiving_ServerId uint64
+	S2S_AntiEntropy_VectorClock        []uint64
 
 	S2C_Client_OperationType uint64
-	S2C_Client_Data          uint64
+	S2C_Client_Status        uint64
+	S2C_Client_Key           []byte
+	S2C_Client_Data          []byte
 	S2C_Client_VersionVector []uint64
 	S2C_Server_Id            uint64
 	S2C_Client_Number        uint64
+	S2C_Client_RequestId     uint64
+	S2C_Client_Wait          uint64
 }
 
 type NServer struct {
 	Id                uint64
 	Self              *protocol.Connection
 	Peers             []*protocol.Connection
+	Transport         Transport
 	PeerConnection    sync.Map
 	PeerAckConnection sync.Map
 	Clients           sync.Map
 
 	UnsatisfiedRequests    []Message
+	ForwardedRequests      []ForwardedRequest
+	ForwardedReplies       []Message
+	ForwardTimeout         uint64
 	VectorClock            []uint64
 	OperationsPerformed    []Operation
 	MyOperations           []Operation
+	MyOperationsOffset     uint64
 	PendingOperations      []Operation
+	KeyValueStore          map[string]Operation
+	StableVersionVector    []uint64
+	AnnouncedStableVector  []uint64
+	SnapshotVersionVector  []uint64
 	GossipAcknowledgements []uint64
+	GossipSentIndex        []uint64
+	GossipUnackedTicks     []uint64
+	GossipRetransmitTicks  uint64
+	SnapshotThreshold      uint64
+	PeerVectorClocks       [][]uint64
+	UnsatisfiedPolicy      uint64
+	Neighbours             []uint64
+	Relay                  bool
+	GossipSentVectors      [][]uint64
+	GossipSentOperations   uint64
+	GossipStreaming        []bool
+	Epoch                  uint64
+	PeerEpochs             []uint64
+	PendingSnapshots       []PendingSnapshot
+	RecoveryWaiting        []bool
+	RecoveryTarget         uint64
+	GossipMaxOperations    uint64
+	GossipMaxBytes         uint64
 	GossipInterval         uint64
+	GossipJitter           uint64
+	GossipMinInterval      uint64
+	GossipMaxInterval      uint64
+	GossipFanout           uint64
+	MaxKeySize             uint64
+	MaxValueSize           uint64
+	Journal                []LogRecord
+	DataDirectory          string
+	SyncPolicy             uint64
+	SyncInterval           uint64
+	SnapshotInterval       uint64
+	AntiEntropyInterval    uint64
+	storage                *storage
 	mu                     sync.Mutex
 }
 
+// Now is the server's clock in microseconds, set by whoever runs
+// ProcessRequest; a parked client request is stamped with it on arrival so
+// that its reply can say how long it waited. ForwardTimeout is in the same
+// unit.
 type Server struct {
 	Id                     uint64
 	NumberOfServers        uint64
 	UnsatisfiedRequests    []Message
+	ForwardedRequests      []ForwardedRequest
+	ForwardedReplies       []Message
+	ForwardTimeout         uint64
 	VectorClock            []uint64
 	OperationsPerformed    []Operation
 	MyOperations           []Operation
+	MyOperationsOffset     uint64
 	PendingOperations      []Operation
+	KeyValueStore          map[string]Operation
+	StableVersionVector    []uint64
+	AnnouncedStableVector  []uint64
+	SnapshotVersionVector  []uint64
 	GossipAcknowledgements []uint64
+	GossipSentIndex        []uint64
+	GossipUnackedTicks     []uint64
+	GossipRetransmitTicks  uint64
+	SnapshotThreshold      uint64
+	PeerVectorClocks       [][]uint64
+	UnsatisfiedPolicy      uint64
+	Neighbours             []uint64
+	Relay                  bool
+	GossipSentVectors      [][]uint64
+	GossipSentOperations   uint64
+	GossipStreaming        []bool
+	Epoch                  uint64
+	PeerEpochs             []uint64
+	PendingSnapshots       []PendingSnapshot
+	RecoveryWaiting        []bool
+	RecoveryTarget         uint64
+	GossipMaxOperations    uint64
+	GossipMaxBytes         uint64
+	InstalledSnapshot      bool
+	MaxKeySize             uint64
+	MaxValueSize           uint64
+	Journal                []LogRecord
+	Now                    uint64
 }
 
 func New(id uint64, self *protocol.Connection, peers []*protocol.Connection, gossipInterval uint64) *NServer {
@@ -75,21 +260,132 @@ func New(id uint64, self *protocol.Connection, peers []*protocol.Connection, gos
 		Id:                     id,
 		Self:                   self,
 		Peers:                  peers,
+		Transport:              TCPTransport{},
 		PeerConnection:         sync.Map{},
 		PeerAckConnection:      sync.Map{},
 		Clients:                sync.Map{},
 		UnsatisfiedRequests:    make([]Message, 0),
+		ForwardedRequests:      make([]ForwardedRequest, 0),
+		ForwardedReplies:       make([]Message, 0),
+		ForwardTimeout:         DefaultForwardTimeout,
 		VectorClock:            make([]uint64, len(peers)),
-		OperationsPerformed:    make([]Operation, 0, 100000),
+		OperationsPerformed:    make([]Operation, 0),
 		MyOperations:           make([]Operation, 0),
-		PendingOperations:      make([]Operation, 0, 100000),
+		MyOperationsOffset:     0,
+		PendingOperations:      make([]Operation, 0),
+		KeyValueStore:          make(map[string]Operation),
+		StableVersionVector:    make([]uint64, len(peers)),
+		AnnouncedStableVector:  make([]uint64, len(peers)),
+		SnapshotVersionVector:  make([]uint64, len(peers)),
 		GossipAcknowledgements: make([]uint64, len(peers)),
+		GossipSentIndex:        make([]uint64, len(peers)),
+		GossipUnackedTicks:     make([]uint64, len(peers)),
+		GossipRetransmitTicks:  DefaultGossipRetransmitTicks,
+		SnapshotThreshold:      DefaultSnapshotThreshold,
+		PeerVectorClocks:       make([][]uint64, len(peers)),
+		UnsatisfiedPolicy:      UnsatisfiedPark,
+		Neighbours:             allPeers(id, uint64(len(peers))),
+		GossipSentVectors:      make([][]uint64, len(peers)),
+		GossipStreaming:        make([]bool, len(peers)),
+		Epoch:                  uint64(time.Now().UnixNano()),
+		PeerEpochs:             make([]uint64, len(peers)),
+		PendingSnapshots:       make([]PendingSnapshot, len(peers)),
+		GossipMaxOperations:    DefaultGossipMaxOperations,
+		GossipMaxBytes:         DefaultGossipMaxBytes,
 		GossipInterval:         gossipInterval,
+		GossipJitter:           DefaultGossipJitter,
+		MaxKeySize:             DefaultMaxKeySize,
+		MaxValueSize:           DefaultMaxValueSize,
+		Journal:                make([]LogRecord, 0),
+		SyncPolicy:             SyncPerOperation,
+		SyncInterval:           DefaultSyncInterval,
+		SnapshotInterval:       DefaultSnapshotInterval,
+		AntiEntropyInterval:    DefaultAntiEntropyInterval,
 	}
 
 	return server
 }
 
+func NewState(id uint64, numberOfServers uint64) Server {
+	return Server{
+		Id:                     id,
+		NumberOfServers:        numberOfServers,
+		UnsatisfiedRequests:    make([]Message, 0),
+		ForwardedRequests:      make([]ForwardedRequest, 0),
+		ForwardedReplies:       make([]Message, 0),
+		ForwardTimeout:         DefaultForwardTimeout,
+		VectorClock:            make([]uint64, numberOfServers),
+		OperationsPerformed:    make([]Operation, 0),
+		MyOperations:           make([]Operation, 0),
+		MyOperationsOffset:     0,
+		PendingOperations:      make([]Operation, 0),
+		KeyValueStore:          make(map[string]Operation),
+		StableVersionVector:    make([]uint64, numberOfServers),
+		AnnouncedStableVector:  make([]uint64, numberOfServers),
+		SnapshotVersionVector:  make([]uint64, numberOfServers),
+		GossipAcknowledgements: make([]uint64, numberOfServers),
+		GossipSentIndex:        make([]uint64, numberOfServers),
+		GossipUnackedTicks:     make([]uint64, numberOfServers),
+		GossipRetransmitTicks:  DefaultGossipRetransmitTicks,
+		SnapshotThreshold:      DefaultSnapshotThreshold,
+		PeerVectorClocks:       make([][]uint64, numberOfServers),
+		UnsatisfiedPolicy:      UnsatisfiedPark,
+		Neighbours:             allPeers(id, numberOfServers),
+		GossipSentVectors:      make([][]uint64, numberOfServers),
+		GossipStreaming:        make([]bool, numberOfServers),
+		Epoch:                  1,
+		PeerEpochs:             make([]uint64, numberOfServers),
+		PendingSnapshots:       make([]PendingSnapshot, numberOfServers),
+		GossipMaxOperations:    DefaultGossipMaxOperations,
+		GossipMaxBytes:         DefaultGossipMaxBytes,
+		MaxKeySize:             DefaultMaxKeySize,
+		MaxValueSize:           DefaultMaxValueSize,
+		Journal:                make([]LogRecord, 0),
+	}
+}
+
+// A gossip tick names the peers to gossip to when only some of the
+// neighbours are picked on each tick; otherwise it goes to all of them.
+func gossipTargets(server Server, request Message) []uint64 {
+	if request.S2S_Gossip_Targets != nil {
+		return request.S2S_Gossip_Targets
+	}
+	return server.Neighbours
+}
+
+// With adaptive gossip the interval halves after every tick that sent
+// operations and doubles after every tick that had nothing to send, within
+// [min, max].
+func NextGossipInterval(interval uint64, min uint64, max uint64, sent uint64) uint64 {
+	if min == 0 || max == 0 {
+		return interval
+	}
+	if sent != 0 {
+		interval = interval / 2
+	} else {
+		interval = interval * 2
+	}
+	if interval < min {
+		interval = min
+	}
+	if interval > max {
+		interval = max
+	}
+	return interval
+}
+
+func allPeers(id uint64, numberOfServers uint64) []uint64 {
+	var peers = make([]uint64, 0)
+	var i = uint64(0)
+	for i < numberOfServers {
+		if i != id {
+			peers = append(peers, i)
+		}
+		i++
+	}
+	return peers
+}
+
 func compareVersionVector(v1 []uint64, v2 []uint64) bool {
 	var output = true
 	var i = uint64(0)
@@ -177,7 +473,7 @@ func equalSlices(s1 []uint64, s2 []uint64) bool {
 }
 
 func equalOperations(o1 Operation, o2 Operation) bool {
-	return equalSlices(o1.VersionVector, o2.VersionVector) && (o1.Data == o2.Data)
+	return equalSlices(o1.VersionVector, o2.VersionVector) && bytes.Equal(o1.Key, o2.Key) && bytes.Equal(o1.Data, o2.Data)
 }
 
 func binarySearch(s []Operation, needle Operation) uint64 {
@@ -220,11 +516,52 @@ func deleteAtIndexMessage(l []Message, index uint64) []Message {
 	return append(ret, l[index+1:]...)
 }
 
-func getDataFromOperationLog(l []Operation) uint64 {
-	if len(l) > 0 {
-		return l[len(l)-1].Data
+func deleteAtIndexForwarded(l []ForwardedRequest, index uint64) []ForwardedRequest {
+	var ret = make([]ForwardedRequest, 0)
+	ret = append(ret, l[:index]...)
+	return append(ret, l[index+1:]...)
+}
+
+// The store keeps, for every key, the operation that would be last for that
+// key in OperationsPerformed, so it must only be replaced by an operation that
+// sorts after it.
+func updateKeyValueStore(store map[string]Operation, operation Operation) map[string]Operation {
+	current, ok := store[string(operation.Key)]
+	if ok && !lexicographicCompare(operation.VersionVector, current.VersionVector) {
+		return store
+	}
+	store[string(operation.Key)] = operation
+	return store
+}
+
+func getDataFromKeyValueStore(store map[string]Operation, key []byte) []byte {
+	operation, ok := store[string(key)]
+	if ok {
+		return operation.Data
+	}
+	return nil
+}
+
+// An operation of our own that comes back from a peer was lost in a crash, and
+// it goes back into MyOperations so that the log still ends at our entry of
+// the vector clock.
+func applyOperation(server Server, operation Operation) Server {
+	own := operation.VersionVector[server.Id] > server.VectorClock[server.Id] &&
+		server.VectorClock[server.Id] == server.MyOperationsOffset+uint64(len(server.MyOperations))
+	return applyLoggedOperation(server, operation, own)
+}
+
+// The log records whether each operation went into MyOperations, so replaying
+// it rebuilds MyOperations the same way.
+func applyLoggedOperation(server Server, operation Operation, own bool) Server {
+	if own {
+		server.MyOperations = append(server.MyOperations, operation)
 	}
-	return 0
+	server.OperationsPerformed = sortedInsert(server.OperationsPerformed, operation)
+	server.KeyValueStore = updateKeyValueStore(server.KeyValueStore, operation)
+	server.VectorClock = maxTS(server.VectorClock, operation.VersionVector)
+	server.Journal = append(server.Journal, LogRecord{Own: own, Operation: operation})
+	return server
 }
 
 func receiveGossip(server Server, request Message) Server {
@@ -236,8 +573,7 @@ func receiveGossip(server Server, request Message) Server {
 
 	for i < uint64(len(request.S2S_Gossip_Operations)) {
 		if oneOffVersionVector(server.VectorClock, request.S2S_Gossip_Operations[i].VersionVector) {
-			server.OperationsPerformed = sortedInsert(server.OperationsPerformed, request.S2S_Gossip_Operations[i])
-			server.VectorClock = maxTS(server.VectorClock, request.S2S_Gossip_Operations[i].VersionVector)
+			server = applyOperation(server, request.S2S_Gossip_Operations[i])
 		} else if compareVersionVector(server.VectorClock, request.S2S_Gossip_Operations[i].VersionVector) {
 			i = i + 1
 			continue
@@ -247,12 +583,15 @@ func receiveGossip(server Server, request Message) Server {
 		i = i + 1
 	}
 
-	i = uint64(0)
+	return applyPendingOperations(server)
+}
+
+func applyPendingOperations(server Server) Server {
+	var i = uint64(0)
 	seen := make([]uint64, 0)
 	for i < uint64(len(server.PendingOperations)) {
 		if oneOffVersionVector(server.VectorClock, server.PendingOperations[i].VersionVector) {
-			server.OperationsPerformed = sortedInsert(server.OperationsPerformed, server.PendingOperations[i])
-			server.VectorClock = maxTS(server.VectorClock, server.PendingOperations[i].VersionVector)
+			server = applyOperation(server, server.PendingOperations[i])
 			seen = append(seen, i)
 		}
 		i = i + 1
@@ -275,37 +614,638 @@ func receiveGossip(server Server, request Message) Server {
 	return server
 }
 
+// The receiver acknowledges how many of the sender's operations it has
+// applied, which may be fewer than it was sent if some are still pending.
+func getGossipAcknowledgement(server Server, serverId uint64) Message {
+	return Message{MessageType: 2,
+		S2S_Acknowledge_Gossip_Sending_ServerId:   server.Id,
+		S2S_Acknowledge_Gossip_Receiving_ServerId: serverId,
+		S2S_Acknowledge_Gossip_Index:              server.VectorClock[serverId],
+		S2S_Acknowledge_Gossip_VectorClock:        append([]uint64(nil), server.VectorClock...),
+		S2S_Acknowledge_Gossip_Epoch:              server.Epoch,
+		S2S_Acknowledge_Gossip_Recovering:         serverId < uint64(len(server.RecoveryWaiting)) && server.RecoveryWaiting[serverId],
+	}
+}
+
+// Every server process picks a new, larger epoch when it starts, and its
+// gossip and acknowledgements carry it. A peer whose epoch goes up has
+// restarted and may have lost state, so what it is known to have starts over
+// from the vector clock it reports. Messages from an earlier epoch are stale,
+// and the returned bool is false for them.
+func observePeerEpoch(server Server, peer uint64, epoch uint64, vectorClock []uint64) (bool, Server) {
+	if peer >= server.NumberOfServers || peer == server.Id || epoch < server.PeerEpochs[peer] {
+		return false, server
+	}
+	if epoch == server.PeerEpochs[peer] || uint64(len(vectorClock)) != server.NumberOfServers {
+		return true, server
+	}
+
+	server.PeerEpochs[peer] = epoch
+	server.GossipAcknowledgements[peer] = vectorClock[server.Id]
+	server.GossipSentIndex[peer] = vectorClock[server.Id]
+	server.GossipUnackedTicks[peer] = 0
+	server.GossipStreaming[peer] = false
+	server.PeerVectorClocks = append([][]uint64(nil), server.PeerVectorClocks...)
+	server.PeerVectorClocks[peer] = append([]uint64(nil), vectorClock...)
+	server.GossipSentVectors = append([][]uint64(nil), server.GossipSentVectors...)
+	server.GossipSentVectors[peer] = append([]uint64(nil), vectorClock...)
+	return true, server
+}
+
+// Acknowledgements from one peer may arrive out of order, so only the highest
+// one counts; a peer that restarted is noticed through its epoch instead.
 func acknowledgeGossip(server Server, request Message) Server {
 	if request.S2S_Acknowledge_Gossip_Sending_ServerId >= uint64(len(server.GossipAcknowledgements)) {
 		return server
 	}
-	server.GossipAcknowledgements[request.S2S_Acknowledge_Gossip_Sending_ServerId] = maxTwoInts(server.GossipAcknowledgements[request.S2S_Acknowledge_Gossip_Sending_ServerId], request.S2S_Acknowledge_Gossip_Index)
+	index := request.S2S_Acknowledge_Gossip_Sending_ServerId
+	if request.S2S_Acknowledge_Gossip_Index > server.GossipAcknowledgements[index] {
+		server.GossipAcknowledgements[index] = request.S2S_Acknowledge_Gossip_Index
+		server.GossipUnackedTicks[index] = 0
+	}
+	server.GossipSentIndex[index] = maxTwoInts(server.GossipSentIndex[index], server.GossipAcknowledgements[index])
+	return server
+}
+
+// A peer needs a snapshot when the operations it is missing have already been
+// compacted away, or when there are so many of them that sending the state is
+// cheaper than sending the log.
+func needsSnapshot(server Server, start uint64) bool {
+	end := server.MyOperationsOffset + uint64(len(server.MyOperations))
+	if start < server.MyOperationsOffset {
+		return true
+	}
+	return server.SnapshotThreshold != 0 && end-start > server.SnapshotThreshold
+}
+
+func getSnapshotOperations(server Server) []Operation {
+	var operations = make([]Operation, 0)
+	for _, operation := range server.KeyValueStore {
+		operations = sortedInsert(operations, operation)
+	}
+	return operations
+}
+
+// A snapshot is split into chunks of the same size as gossip messages.
+func getSnapshotMessages(server Server, receiver uint64) []Message {
+	var chunks = make([][]Operation, 0)
+	operations := getSnapshotOperations(server)
+	for len(chunks) == 0 || uint64(len(operations)) != 0 {
+		chunk, _ := limitGossipOperations(server, operations)
+		chunks = append(chunks, chunk)
+		operations = operations[len(chunk):]
+	}
+
+	var messages = make([]Message, 0, len(chunks))
+	for i, chunk := range chunks {
+		messages = append(messages, Message{MessageType: 5,
+			S2S_Snapshot_Sending_ServerId:   server.Id,
+			S2S_Snapshot_Receiving_ServerId: receiver,
+			S2S_Snapshot_Operations:         chunk,
+			S2S_Snapshot_VersionVector:      append([]uint64(nil), server.VectorClock...),
+			S2S_Snapshot_Chunk:              uint64(i),
+			S2S_Snapshot_Chunks:             uint64(len(chunks)),
+		})
+	}
+	return messages
+}
+
+// The chunks of a snapshot may arrive in any order, and nothing of it is
+// installed before all of them have, since its writes are only covered by
+// its vector clock as a whole. A chunk of a different snapshot from the same
+// peer replaces the one being collected.
+func collectSnapshotChunk(server Server, request Message) (bool, Server, Message) {
+	if request.S2S_Snapshot_Chunks <= 1 {
+		return true, server, request
+	}
+	sender := request.S2S_Snapshot_Sending_ServerId
+	if sender >= server.NumberOfServers || request.S2S_Snapshot_Chunk >= request.S2S_Snapshot_Chunks {
+		return false, server, request
+	}
+
+	server.PendingSnapshots = append([]PendingSnapshot(nil), server.PendingSnapshots...)
+	pending := server.PendingSnapshots[sender]
+	if !equalSlices(pending.VersionVector, request.S2S_Snapshot_VersionVector) ||
+		uint64(len(pending.Received)) != request.S2S_Snapshot_Chunks {
+		pending = PendingSnapshot{
+			VersionVector: request.S2S_Snapshot_VersionVector,
+			Operations:    make([]Operation, 0),
+			Received:      make([]bool, request.S2S_Snapshot_Chunks),
+		}
+	}
+	if !pending.Received[request.S2S_Snapshot_Chunk] {
+		pending.Received = append([]bool(nil), pending.Received...)
+		pending.Received[request.S2S_Snapshot_Chunk] = true
+		pending.Operations = append(append([]Operation(nil), pending.Operations...), request.S2S_Snapshot_Operations...)
+	}
+
+	for _, received := range pending.Received {
+		if !received {
+			server.PendingSnapshots[sender] = pending
+			return false, server, request
+		}
+	}
+	server.PendingSnapshots[sender] = PendingSnapshot{}
+	request.S2S_Snapshot_Operations = pending.Operations
+	return true, server, request
+}
+
+// Snapshots are merged rather than replacing the state: the store keeps the
+// last operation per key in lexicographic order, so merging two stores gives
+// the same result as applying both sets of operations.
+func installSnapshot(server Server, request Message) Server {
+	if uint64(len(request.S2S_Snapshot_VersionVector)) != uint64(len(server.VectorClock)) ||
+		compareVersionVector(server.VectorClock, request.S2S_Snapshot_VersionVector) {
+		return server
+	}
+
+	var i = uint64(0)
+	for i < uint64(len(request.S2S_Snapshot_Operations)) {
+		server.KeyValueStore = updateKeyValueStore(server.KeyValueStore, request.S2S_Snapshot_Operations[i])
+		i++
+	}
+	server.VectorClock = maxTS(server.VectorClock, request.S2S_Snapshot_VersionVector)
+	server.SnapshotVersionVector = maxTS(server.SnapshotVersionVector, request.S2S_Snapshot_VersionVector)
+	server.InstalledSnapshot = true
+
+	// The peer has operations of ours that we lost, so our own log restarts
+	// after them and they reach other peers through the peer's snapshots.
+	if server.VectorClock[server.Id] > server.MyOperationsOffset+uint64(len(server.MyOperations)) {
+		server.MyOperations = make([]Operation, 0)
+		server.MyOperationsOffset = server.VectorClock[server.Id]
+	}
+
+	return applyPendingOperations(server)
+}
+
+func processUnsatisfiedRequests(server Server) (Server, []Message) {
+	var outGoingRequests = make([]Message, 0)
+	var s = server
+	var i = uint64(0)
+	var reply = Message{}
+	var succeeded = false
+
+	for i < uint64(len(s.UnsatisfiedRequests)) {
+		succeeded, s, reply = processClientRequest(s, s.UnsatisfiedRequests[i])
+		if succeeded {
+			if s.Now > s.UnsatisfiedRequests[i].C2S_Client_ReceivedTime {
+				reply.S2C_Client_Wait = s.Now - s.UnsatisfiedRequests[i].C2S_Client_ReceivedTime
+			}
+			if s.UnsatisfiedRequests[i].MessageType == 7 {
+				reply = forwardedReply(s, s.UnsatisfiedRequests[i], reply)
+				s = rememberForwardedReply(s, reply)
+			}
+			outGoingRequests = append(outGoingRequests, reply)
+			s.UnsatisfiedRequests = deleteAtIndexMessage(s.UnsatisfiedRequests, i)
+			continue
+		}
+		i++
+	}
+
+	return s, outGoingRequests
+}
+
+func sameClientRequest(m1 Message, m2 Message) bool {
+	return m1.C2S_Client_Id == m2.C2S_Client_Id && m1.C2S_Client_RequestId == m2.C2S_Client_RequestId
+}
+
+// A client that has given up on a request asks for it to be dropped, so that
+// it is not served after the client has stopped waiting for the reply. The
+// client is only told the request was cancelled if it had not been served
+// yet, so it knows whether it may retry the request elsewhere. A cancel of a
+// forwarded request (type 11) only drops the copy forwarded by its sender.
+func cancelClientRequest(server Server, request Message) (bool, Server) {
+	var i = uint64(0)
+	for i < uint64(len(server.UnsatisfiedRequests)) {
+		parked := server.UnsatisfiedRequests[i]
+		forwarded := parked.MessageType == 7
+		if sameClientRequest(parked, request) && forwarded == (request.MessageType == 11) &&
+			(!forwarded || parked.S2S_Forward_Sending_ServerId == request.S2S_Forward_Sending_ServerId) {
+			server.UnsatisfiedRequests = deleteAtIndexMessage(server.UnsatisfiedRequests, i)
+			return true, server
+		}
+		i++
+	}
+	return false, server
+}
+
+// A request this server forwarded is parked at the peer, so a cancel for it
+// is passed on there; the peer's reply, served or cancelled, comes back as a
+// forwarded reply.
+func cancelForwardedRequest(server Server, request Message) (bool, Server, Message) {
+	var i = uint64(0)
+	for i < uint64(len(server.ForwardedRequests)) {
+		if sameClientRequest(server.ForwardedRequests[i].Request, request) {
+			var cancel = request
+			cancel.MessageType = 11
+			cancel.S2S_Forward_Sending_ServerId = server.Id
+			cancel.S2S_Forward_Receiving_ServerId = server.ForwardedRequests[i].Request.S2S_Forward_Receiving_ServerId
+			cancel.S2S_Forward_VectorClock = append([]uint64(nil), server.VectorClock...)
+			server.ForwardedRequests = deleteAtIndexForwarded(server.ForwardedRequests, i)
+			return true, server, cancel
+		}
+		i++
+	}
+	return false, server, Message{}
+}
+
+// A forwarded request may have been sent more than once, so only the first
+// reply to it is passed on to the client. The reply to a cancelled request
+// comes after its entry is gone.
+func forwardedRequestDone(server Server, reply Message) (bool, Server) {
+	var i = uint64(0)
+	for i < uint64(len(server.ForwardedRequests)) {
+		if server.ForwardedRequests[i].Request.C2S_Client_Id == reply.S2C_Client_Number &&
+			server.ForwardedRequests[i].Request.C2S_Client_RequestId == reply.S2C_Client_RequestId {
+			server.ForwardedRequests = deleteAtIndexForwarded(server.ForwardedRequests, i)
+			return true, server
+		}
+		i++
+	}
+	return reply.S2C_Client_Status == StatusCancelled, server
+}
+
+// A forwarded request or its reply may be lost, so a request that has not
+// been answered within ForwardTimeout is sent to the peer again. If the
+// peer's clock no longer covers the request's dependencies, it has restarted
+// behind and forgotten the request, which is then parked here instead.
+func retransmitForwardedRequests(server Server) (Server, []Message) {
+	var outGoingRequests = make([]Message, 0)
+	if server.ForwardTimeout == 0 || uint64(len(server.ForwardedRequests)) == 0 {
+		return server, outGoingRequests
+	}
+
+	var forwarded = make([]ForwardedRequest, 0, len(server.ForwardedRequests))
+	var parked = false
+	for _, f := range server.ForwardedRequests {
+		if server.Now < f.SentTime+server.ForwardTimeout {
+			forwarded = append(forwarded, f)
+			continue
+		}
+		peer := f.Request.S2S_Forward_Receiving_ServerId
+		if !compareVersionVector(server.PeerVectorClocks[peer], f.Request.C2S_Client_VersionVector) {
+			var request = f.Request
+			request.MessageType = 0
+			server.UnsatisfiedRequests = append(server.UnsatisfiedRequests, request)
+			parked = true
+			continue
+		}
+		forward := forwardRequest(server, f.Request, peer)
+		forwarded = append(forwarded, ForwardedRequest{Request: forward, SentTime: server.Now})
+		outGoingRequests = append(outGoingRequests, forward)
+	}
+	server.ForwardedRequests = forwarded
+
+	if parked {
+		var replies []Message
+		server, replies = processUnsatisfiedRequests(server)
+		outGoingRequests = append(outGoingRequests, replies...)
+	}
+	return server, outGoingRequests
+}
+
+// The peer remembers its last reply to a forwarded request of every client,
+// and answers a copy of the request with it rather than serving it twice.
+func servedForwardedRequest(server Server, request Message) (bool, Message) {
+	for _, reply := range server.ForwardedReplies {
+		if reply.S2C_Client_Number == request.C2S_Client_Id && reply.S2C_Client_RequestId == request.C2S_Client_RequestId {
+			reply.S2S_Forward_Receiving_ServerId = request.S2S_Forward_Sending_ServerId
+			return true, reply
+		}
+	}
+	return false, Message{}
+}
+
+func rememberForwardedReply(server Server, reply Message) Server {
+	var replies = make([]Message, 0, len(server.ForwardedReplies)+1)
+	for _, r := range server.ForwardedReplies {
+		if r.S2C_Client_Number != reply.S2C_Client_Number {
+			replies = append(replies, r)
+		}
+	}
+	server.ForwardedReplies = append(replies, reply)
+	return server
+}
+
+func parkedForwardedRequest(server Server, request Message) bool {
+	for _, parked := range server.UnsatisfiedRequests {
+		if parked.MessageType == 7 && sameClientRequest(parked, request) {
+			return true
+		}
+	}
+	return false
+}
+
+func observePeerVectorClock(server Server, peer uint64, vectorClock []uint64) Server {
+	if peer >= server.NumberOfServers || peer == server.Id || uint64(len(vectorClock)) != server.NumberOfServers {
+		return server
+	}
+	var clocks = append([][]uint64(nil), server.PeerVectorClocks...)
+	if clocks[peer] == nil {
+		clocks[peer] = append([]uint64(nil), vectorClock...)
+	} else {
+		clocks[peer] = maxTS(clocks[peer], vectorClock)
+	}
+	server.PeerVectorClocks = clocks
 	return server
 }
 
-func getGossipOperations(server Server, serverId uint64) []Operation {
+// forwardPeer picks the first peer after this server whose last known vector
+// clock dominates the request's dependencies.
+func forwardPeer(server Server, request Message) (uint64, bool) {
+	var i = uint64(1)
+	for i < server.NumberOfServers {
+		peer := (server.Id + i) % server.NumberOfServers
+		if server.PeerVectorClocks[peer] != nil && compareVersionVector(server.PeerVectorClocks[peer], request.C2S_Client_VersionVector) {
+			return peer, true
+		}
+		i++
+	}
+	return server.Id, false
+}
+
+func forwardRequest(server Server, request Message, peer uint64) Message {
+	var forward = request
+	forward.MessageType = 7
+	forward.S2S_Forward_Sending_ServerId = server.Id
+	forward.S2S_Forward_Receiving_ServerId = peer
+	forward.S2S_Forward_VectorClock = append([]uint64(nil), server.VectorClock...)
+	return forward
+}
+
+// The reply to a forwarded request goes back through the server the client
+// sent it to, which relays it on the client's connection.
+func forwardedReply(server Server, request Message, reply Message) Message {
+	var forward = reply
+	forward.MessageType = 8
+	forward.S2S_Forward_Sending_ServerId = server.Id
+	forward.S2S_Forward_Receiving_ServerId = request.S2S_Forward_Sending_ServerId
+	forward.S2S_Forward_VectorClock = append([]uint64(nil), server.VectorClock...)
+	return forward
+}
+
+// Anti-entropy lets a server recover operations from any origin, including
+// ones whose origin has crashed before gossiping them to everyone. The peer
+// answers with the operations it has that the requester's vector clock does
+// not cover, as many as fit in one gossip message, and the requester pulls
+// the rest in later rounds. Operations are in lexicographic order, so the
+// ones sent are closed under causality. If some of them are no longer in
+// OperationsPerformed the peer sends a snapshot instead.
+func antiEntropyReply(server Server, request Message) []Message {
+	requester := request.S2S_AntiEntropy_Sending_ServerId
+	vectorClock := request.S2S_AntiEntropy_VectorClock
+	if requester >= server.NumberOfServers || requester == server.Id || uint64(len(vectorClock)) != server.NumberOfServers ||
+		compareVersionVector(vectorClock, server.VectorClock) {
+		return make([]Message, 0)
+	}
+
+	if !compareVersionVector(vectorClock, getLoggedVersionVector(server)) {
+		return getSnapshotMessages(server, requester)
+	}
+
+	var operations = make([]Operation, 0)
+	var i = uint64(0)
+	for i < uint64(len(server.OperationsPerformed)) {
+		if !compareVersionVector(vectorClock, server.OperationsPerformed[i].VersionVector) {
+			operations = append(operations, server.OperationsPerformed[i])
+		}
+		i++
+	}
+	operations, _ = limitGossipOperations(server, operations)
+
+	return []Message{{MessageType: 1,
+		S2S_Gossip_Sending_ServerId:    server.Id,
+		S2S_Gossip_Receiving_ServerId:  requester,
+		S2S_Gossip_Operations:          operations,
+		S2S_Gossip_Index:               server.MyOperationsOffset + uint64(len(server.MyOperations)),
+		S2S_Gossip_StableVersionVector: append([]uint64(nil), server.StableVersionVector...),
+		S2S_Gossip_VectorClock:         append([]uint64(nil), server.VectorClock...),
+		S2S_Gossip_Epoch:               server.Epoch,
+	}}
+}
+
+// Replies that do not serve the request carry the server's vector clock, so
+// the client learns how far behind the server is.
+func statusReply(server Server, request Message, status uint64) Message {
+	var reply = Message{}
+	reply.MessageType = 4
+	reply.S2C_Client_OperationType = request.C2S_Client_OperationType
+	reply.S2C_Client_Status = status
+	reply.S2C_Client_Key = request.C2S_Client_Key
+	reply.S2C_Client_VersionVector = append(make([]uint64, 0), server.VectorClock...)
+	reply.S2C_Server_Id = server.Id
+	reply.S2C_Client_Number = request.C2S_Client_Id
+	reply.S2C_Client_RequestId = request.C2S_Client_RequestId
+	return reply
+}
+
+func getGossipOperations(server Server, start uint64) []Operation {
 	var ret = make([]Operation, 0)
-	if serverId >= uint64(len(server.GossipAcknowledgements)) || (server.GossipAcknowledgements[serverId] >= uint64(len(server.MyOperations))) {
+	if start >= server.MyOperationsOffset+uint64(len(server.MyOperations)) {
 		return ret
 	}
 
-	return append(ret, server.MyOperations[server.GossipAcknowledgements[serverId]:]...)
+	var i = uint64(0)
+	if start > server.MyOperationsOffset {
+		i = start - server.MyOperationsOffset
+	}
+
+	return append(ret, server.MyOperations[i:]...)
+}
+
+// A gossip message carries at most GossipMaxOperations operations and about
+// GossipMaxBytes of them, but always at least one; zero means no limit.
+func limitGossipOperations(server Server, operations []Operation) ([]Operation, bool) {
+	var bytes = uint64(0)
+	var i = uint64(0)
+	for i < uint64(len(operations)) {
+		if server.GossipMaxOperations != 0 && i >= server.GossipMaxOperations {
+			return operations[:i], true
+		}
+		bytes += uint64(len(operations[i].Key)+len(operations[i].Data)) + 8*uint64(len(operations[i].VersionVector))
+		if server.GossipMaxBytes != 0 && bytes > server.GossipMaxBytes && i != 0 {
+			return operations[:i], true
+		}
+		i++
+	}
+	return operations, false
+}
+
+// A backlog larger than one message is streamed: the next chunk goes out as
+// soon as the peer acknowledges the previous one instead of on the next tick.
+func pushGossipTo(server Server, index uint64, send bool, start uint64, announce bool) (Server, []Message) {
+	var outGoingRequests = make([]Message, 0)
+	var operations = make([]Operation, 0)
+	if send && needsSnapshot(server, start) {
+		server.GossipSentIndex[index] = server.MyOperationsOffset + uint64(len(server.MyOperations))
+		server.GossipStreaming[index] = false
+
+		outGoingRequests = append(outGoingRequests, getSnapshotMessages(server, index)...)
+	} else if send {
+		var truncated = false
+		operations, truncated = limitGossipOperations(server, getGossipOperations(server, start))
+		server.GossipSentOperations += uint64(len(operations))
+		server.GossipSentIndex[index] = maxTwoInts(start, server.MyOperationsOffset) + uint64(len(operations))
+		server.GossipStreaming[index] = truncated
+	}
+	if uint64(len(operations)) != uint64(0) || announce {
+		outGoingRequests = append(outGoingRequests,
+			Message{MessageType: 1,
+				S2S_Gossip_Sending_ServerId:    server.Id,
+				S2S_Gossip_Receiving_ServerId:  index,
+				S2S_Gossip_Operations:          operations,
+				S2S_Gossip_Index:               server.MyOperationsOffset + uint64(len(server.MyOperations)),
+				S2S_Gossip_StableVersionVector: append([]uint64(nil), server.StableVersionVector...),
+				S2S_Gossip_VectorClock:         append([]uint64(nil), server.VectorClock...),
+				S2S_Gossip_Epoch:               server.Epoch,
+			})
+	}
+	return server, outGoingRequests
+}
+
+func streamGossip(server Server, request Message) (Server, []Message) {
+	index := request.S2S_Acknowledge_Gossip_Sending_ServerId
+	if index >= server.NumberOfServers || index == server.Id || !server.GossipStreaming[index] {
+		return server, make([]Message, 0)
+	}
+	if server.Relay {
+		return relayGossipTo(server, index, false, false)
+	}
+	if server.GossipAcknowledgements[index] < server.GossipSentIndex[index] {
+		return server, make([]Message, 0)
+	}
+	start := server.GossipSentIndex[index]
+	return pushGossipTo(server, index, start < server.MyOperationsOffset+uint64(len(server.MyOperations)), start, false)
+}
+
+// Operations past GossipSentIndex are sent once; if the acknowledgement does
+// not advance for GossipRetransmitTicks ticks, everything after it is sent
+// again.
+func getGossipStart(server Server, serverId uint64) (bool, Server, uint64) {
+	end := server.MyOperationsOffset + uint64(len(server.MyOperations))
+	if server.GossipAcknowledgements[serverId] >= end {
+		server.GossipUnackedTicks[serverId] = 0
+		return false, server, end
+	}
+
+	start := maxTwoInts(server.GossipSentIndex[serverId], server.GossipAcknowledgements[serverId])
+	if server.GossipAcknowledgements[serverId] < server.GossipSentIndex[serverId] {
+		server.GossipUnackedTicks[serverId] += 1
+		if server.GossipUnackedTicks[serverId] >= server.GossipRetransmitTicks {
+			server.GossipUnackedTicks[serverId] = 0
+			start = server.GossipAcknowledgements[serverId]
+		}
+	}
+
+	return start < end, server, start
+}
+
+// OperationsPerformed has every operation the server has applied except the
+// ones compacted away and the ones that came in snapshots, so a peer whose
+// clock does not cover both may need some that are only in the store.
+func getLoggedVersionVector(server Server) []uint64 {
+	return maxTS(server.StableVersionVector, server.SnapshotVersionVector)
+}
+
+func mergeStableVersionVector(server Server, request Message) Server {
+	if uint64(len(request.S2S_Gossip_StableVersionVector)) != uint64(len(server.StableVersionVector)) {
+		return server
+	}
+	server.StableVersionVector = maxTS(server.StableVersionVector, request.S2S_Gossip_StableVersionVector)
+	return server
+}
+
+// Every peer has acknowledged the first minimum acknowledgement operations in
+// MyOperations, so they form the stable prefix for this server's own entry.
+func updateStableVersionVector(server Server) Server {
+	var i = uint64(0)
+	var stable = server.MyOperationsOffset + uint64(len(server.MyOperations))
+	for i < server.NumberOfServers {
+		if i != server.Id && server.GossipAcknowledgements[i] < stable {
+			stable = server.GossipAcknowledgements[i]
+		}
+		i++
+	}
+
+	server.StableVersionVector = append([]uint64(nil), server.StableVersionVector...)
+	server.StableVersionVector[server.Id] = maxTwoInts(server.StableVersionVector[server.Id], stable)
+	return server
+}
+
+// Operations covered by the stable version vector have been applied by every
+// replica and are already folded into the KeyValueStore, so they no longer
+// need to be kept in the logs.
+func compactOperations(server Server) Server {
+	var i = uint64(0)
+	var operationsPerformed = make([]Operation, 0)
+	for i < uint64(len(server.OperationsPerformed)) {
+		if !compareVersionVector(server.StableVersionVector, server.OperationsPerformed[i].VersionVector) {
+			operationsPerformed = append(operationsPerformed, server.OperationsPerformed[i])
+		}
+		i++
+	}
+	server.OperationsPerformed = operationsPerformed
+
+	i = uint64(0)
+	var pendingOperations = make([]Operation, 0)
+	for i < uint64(len(server.PendingOperations)) {
+		if !compareVersionVector(server.VectorClock, server.PendingOperations[i].VersionVector) {
+			pendingOperations = append(pendingOperations, server.PendingOperations[i])
+		}
+		i++
+	}
+	server.PendingOperations = pendingOperations
+
+	if server.StableVersionVector[server.Id] > server.MyOperationsOffset {
+		truncate := server.StableVersionVector[server.Id] - server.MyOperationsOffset
+		if truncate > uint64(len(server.MyOperations)) {
+			truncate = uint64(len(server.MyOperations))
+		}
+		server.MyOperations = append(make([]Operation, 0), server.MyOperations[truncate:]...)
+		server.MyOperationsOffset = server.MyOperationsOffset + truncate
+	}
+
+	return server
+}
+
+func checkClientRequest(server Server, request Message) uint64 {
+	if uint64(len(request.C2S_Client_VersionVector)) != server.NumberOfServers {
+		return StatusBadVector
+	}
+	if uint64(len(request.C2S_Client_Key)) > server.MaxKeySize {
+		return StatusKeyTooLarge
+	}
+	if request.C2S_Client_OperationType == 1 && uint64(len(request.C2S_Client_Data)) > server.MaxValueSize {
+		return StatusValueTooLarge
+	}
+	return StatusOk
 }
 
 func processClientRequest(server Server, request Message) (bool, Server, Message) {
 	var reply = Message{}
 
+	status := checkClientRequest(server, request)
+	if status != StatusOk {
+		return true, server, statusReply(server, request, status)
+	}
+
 	if !compareVersionVector(server.VectorClock, request.C2S_Client_VersionVector) {
 		return false, server, reply
 	}
 
+	if request.C2S_Client_OperationType != 0 && recovering(server) {
+		return false, server, reply
+	}
+
 	if request.C2S_Client_OperationType == 0 {
 		reply.MessageType = 4
 		reply.S2C_Client_OperationType = 0
-		reply.S2C_Client_Data = getDataFromOperationLog(server.OperationsPerformed)
+		reply.S2C_Client_Key = request.C2S_Client_Key
+		reply.S2C_Client_Data = getDataFromKeyValueStore(server.KeyValueStore, request.C2S_Client_Key)
 		reply.S2C_Client_VersionVector = append(make([]uint64, 0), server.VectorClock...)
 		reply.S2C_Server_Id = server.Id
 		reply.S2C_Client_Number = request.C2S_Client_Id
+		reply.S2C_Client_RequestId = request.C2S_Client_RequestId
 
 		return true, server, reply
 	} else {
@@ -314,101 +1254,290 @@ func processClientRequest(server Server, request Message) (bool, Server, Message
 
 		s.OperationsPerformed = sortedInsert(s.OperationsPerformed, Operation{
 			VersionVector: append([]uint64(nil), s.VectorClock...),
+			Key:           request.C2S_Client_Key,
 			Data:          request.C2S_Client_Data,
 		})
 
 		s.MyOperations = sortedInsert(s.MyOperations, Operation{
 			VersionVector: append([]uint64(nil), s.VectorClock...),
+			Key:           request.C2S_Client_Key,
 			Data:          request.C2S_Client_Data,
 		})
 
+		s.KeyValueStore = updateKeyValueStore(s.KeyValueStore, Operation{
+			VersionVector: append([]uint64(nil), s.VectorClock...),
+			Key:           request.C2S_Client_Key,
+			Data:          request.C2S_Client_Data,
+		})
+
+		s.Journal = append(s.Journal, LogRecord{Own: true, Operation: Operation{
+			VersionVector: append([]uint64(nil), s.VectorClock...),
+			Key:           request.C2S_Client_Key,
+			Data:          request.C2S_Client_Data,
+		}})
+
 		reply.MessageType = 4
 		reply.S2C_Client_OperationType = 1
-		reply.S2C_Client_Data = 0
+		reply.S2C_Client_Key = request.C2S_Client_Key
+		reply.S2C_Client_Data = nil
 		reply.S2C_Client_VersionVector = append(make([]uint64, 0), s.VectorClock...)
 		reply.S2C_Server_Id = s.Id
 		reply.S2C_Client_Number = request.C2S_Client_Id
+		reply.S2C_Client_RequestId = request.C2S_Client_RequestId
 
 		return true, s, reply
 	}
 }
 
-func processRequest(server Server, request Message) (Server, []Message) {
+func ProcessRequest(server Server, request Message) (Server, []Message) {
 	var outGoingRequests = make([]Message, 0)
 	var s = server
 	if request.MessageType == 0 {
 		var succeeded = false
 		var reply = Message{}
 
+		request.C2S_Client_ReceivedTime = s.Now
 		succeeded, s, reply = processClientRequest(s, request)
 		if succeeded {
 			outGoingRequests = append(outGoingRequests, reply)
+		} else if request.C2S_Client_Reject || s.UnsatisfiedPolicy == UnsatisfiedReject {
+			outGoingRequests = append(outGoingRequests, statusReply(s, request, StatusUnsatisfied))
+		} else if peer, ok := forwardPeer(s, request); ok && s.UnsatisfiedPolicy == UnsatisfiedForward {
+			forward := forwardRequest(s, request, peer)
+			s.ForwardedRequests = append(s.ForwardedRequests, ForwardedRequest{Request: forward, SentTime: s.Now})
+			outGoingRequests = append(outGoingRequests, forward)
 		} else {
 			s.UnsatisfiedRequests = append(s.UnsatisfiedRequests, request)
 		}
-	} else if request.MessageType == 1 {
-		s = receiveGossip(s, request)
-
-		var i = uint64(0)
-		var reply = Message{}
+	} else if request.MessageType == 7 {
 		var succeeded = false
 
-		for i < uint64(len(s.UnsatisfiedRequests)) {
-			succeeded, s, reply = processClientRequest(s, s.UnsatisfiedRequests[i])
+		s = observePeerVectorClock(s, request.S2S_Forward_Sending_ServerId, request.S2S_Forward_VectorClock)
+		request.C2S_Client_ReceivedTime = s.Now
+		served, reply := servedForwardedRequest(s, request)
+		if served {
+			outGoingRequests = append(outGoingRequests, reply)
+		} else if !parkedForwardedRequest(s, request) {
+			succeeded, s, reply = processClientRequest(s, request)
 			if succeeded {
+				reply = forwardedReply(s, request, reply)
+				s = rememberForwardedReply(s, reply)
 				outGoingRequests = append(outGoingRequests, reply)
-				s.UnsatisfiedRequests = deleteAtIndexMessage(s.UnsatisfiedRequests, i)
-				continue
+			} else {
+				s.UnsatisfiedRequests = append(s.UnsatisfiedRequests, request)
 			}
-			i++
 		}
+	} else if request.MessageType == 8 {
+		s = observePeerVectorClock(s, request.S2S_Forward_Sending_ServerId, request.S2S_Forward_VectorClock)
+		var pending = false
+		pending, s = forwardedRequestDone(s, request)
+		if pending {
+			var reply = request
+			reply.MessageType = 4
+			reply.S2S_Forward_VectorClock = nil
+			outGoingRequests = append(outGoingRequests, reply)
+		}
+	} else if request.MessageType == 1 {
+		_, s = observePeerEpoch(s, request.S2S_Gossip_Sending_ServerId, request.S2S_Gossip_Epoch, request.S2S_Gossip_VectorClock)
+		s = observePeerVectorClock(s, request.S2S_Gossip_Sending_ServerId, request.S2S_Gossip_VectorClock)
+		s = mergePeerVectorClocks(s, request)
+		s = mergeStableVersionVector(s, request)
+		s = receiveGossip(s, request)
 
+		var messages []Message
+		s, messages = observeRecoveryClock(s, request.S2S_Gossip_Sending_ServerId, request.S2S_Gossip_VectorClock)
+		outGoingRequests = append(outGoingRequests, messages...)
+
+		if request.S2S_Gossip_Sending_ServerId < s.NumberOfServers && request.S2S_Gossip_Sending_ServerId != s.Id {
+			outGoingRequests = append(outGoingRequests, getGossipAcknowledgement(s, request.S2S_Gossip_Sending_ServerId))
+		}
+
+		var replies []Message
+		s, replies = processUnsatisfiedRequests(s)
+		outGoingRequests = append(outGoingRequests, replies...)
+	} else if request.MessageType == 5 {
+		s = observePeerVectorClock(s, request.S2S_Snapshot_Sending_ServerId, request.S2S_Snapshot_VersionVector)
+		complete, ns, snapshot := collectSnapshotChunk(s, request)
+		s = ns
+		if complete {
+			s = installSnapshot(s, snapshot)
+		}
+
+		var messages []Message
+		s, messages = observeRecoveryClock(s, request.S2S_Snapshot_Sending_ServerId, request.S2S_Snapshot_VersionVector)
+		outGoingRequests = append(outGoingRequests, messages...)
+
+		if request.S2S_Snapshot_Sending_ServerId < s.NumberOfServers && request.S2S_Snapshot_Sending_ServerId != s.Id {
+			outGoingRequests = append(outGoingRequests, getGossipAcknowledgement(s, request.S2S_Snapshot_Sending_ServerId))
+		}
+
+		var replies []Message
+		s, replies = processUnsatisfiedRequests(s)
+		outGoingRequests = append(outGoingRequests, replies...)
+	} else if request.MessageType == 6 {
+		var cancelled = false
+		cancelled, s = cancelClientRequest(s, request)
+		if cancelled {
+			outGoingRequests = append(outGoingRequests, statusReply(s, request, StatusCancelled))
+		} else if forwarded, ns, cancel := cancelForwardedRequest(s, request); forwarded {
+			s = ns
+			outGoingRequests = append(outGoingRequests, cancel)
+		}
+	} else if request.MessageType == 11 {
+		s = observePeerVectorClock(s, request.S2S_Forward_Sending_ServerId, request.S2S_Forward_VectorClock)
+
+		var cancelled = false
+		cancelled, s = cancelClientRequest(s, request)
+		if cancelled {
+			outGoingRequests = append(outGoingRequests, forwardedReply(s, request, statusReply(s, request, StatusCancelled)))
+		}
+	} else if request.MessageType == 9 {
+		s = observePeerVectorClock(s, request.S2S_AntiEntropy_Sending_ServerId, request.S2S_AntiEntropy_VectorClock)
+
+		outGoingRequests = append(outGoingRequests, antiEntropyReply(s, request)...)
+	} else if request.MessageType == 10 {
+		if request.S2S_AntiEntropy_Receiving_ServerId < s.NumberOfServers && request.S2S_AntiEntropy_Receiving_ServerId != s.Id {
+			outGoingRequests = append(outGoingRequests,
+				Message{MessageType: 9,
+					S2S_AntiEntropy_Sending_ServerId:   s.Id,
+					S2S_AntiEntropy_Receiving_ServerId: request.S2S_AntiEntropy_Receiving_ServerId,
+					S2S_AntiEntropy_VectorClock:        append([]uint64(nil), s.VectorClock...),
+				})
+		}
 	} else if request.MessageType == 2 {
-		s = acknowledgeGossip(s, request)
+		var current = false
+		current, s = observePeerEpoch(s, request.S2S_Acknowledge_Gossip_Sending_ServerId, request.S2S_Acknowledge_Gossip_Epoch,
+			request.S2S_Acknowledge_Gossip_VectorClock)
+		if current {
+			s = acknowledgeGossip(s, request)
+			if s.Relay {
+				s = acknowledgeRelayGossip(s, request)
+			}
+
+			var messages []Message
+			s, messages = streamGossip(s, request)
+			outGoingRequests = append(outGoingRequests, messages...)
+
+			s, messages = observeRecoveryClock(s, request.S2S_Acknowledge_Gossip_Sending_ServerId, request.S2S_Acknowledge_Gossip_VectorClock)
+			outGoingRequests = append(outGoingRequests, messages...)
+
+			if request.S2S_Acknowledge_Gossip_Recovering {
+				outGoingRequests = append(outGoingRequests, getGossipAcknowledgement(s, request.S2S_Acknowledge_Gossip_Sending_ServerId))
+			}
+		}
+	} else if request.MessageType == 3 && s.Relay {
+		var messages []Message
+		s, messages = relayGossip(s, gossipTargets(s, request))
+		outGoingRequests = append(outGoingRequests, messages...)
+		outGoingRequests = append(outGoingRequests, getRecoveryAcknowledgements(s)...)
+
+		s, messages = retransmitForwardedRequests(s)
+		outGoingRequests = append(outGoingRequests, messages...)
 	} else if request.MessageType == 3 {
-		var i = uint64(0)
-		for i < server.NumberOfServers {
-			if uint64(i) != uint64(s.Id) {
-				index := uint64(i)
-				operations := getGossipOperations(s, index)
-				if uint64(len(operations)) != uint64(0) {
-					server.GossipAcknowledgements[index] = uint64(len(s.MyOperations))
-
-					outGoingRequests = append(outGoingRequests,
-						Message{MessageType: 1,
-							S2S_Gossip_Sending_ServerId:   s.Id,
-							S2S_Gossip_Receiving_ServerId: index,
-							S2S_Gossip_Operations:         operations,
-							S2S_Gossip_Index:              uint64(len(s.MyOperations)),
-						})
-				}
+		outGoingRequests = append(outGoingRequests, getRecoveryAcknowledgements(s)...)
+
+		var retransmitted []Message
+		s, retransmitted = retransmitForwardedRequests(s)
+		outGoingRequests = append(outGoingRequests, retransmitted...)
+		s = updateStableVersionVector(s)
+		announce := !equalSlices(s.StableVersionVector, s.AnnouncedStableVector)
+
+		s.GossipSentOperations = 0
+		for _, index := range gossipTargets(s, request) {
+			if index < s.NumberOfServers && index != s.Id {
+				send, ns, start := getGossipStart(s, index)
+				var messages []Message
+				s, messages = pushGossipTo(ns, index, send, start, announce)
+				outGoingRequests = append(outGoingRequests, messages...)
 			}
-			i = i + 1
 		}
+
+		s.AnnouncedStableVector = append([]uint64(nil), s.StableVersionVector...)
+		s = compactOperations(s)
 	}
 
 	return s, outGoingRequests
 }
 
 func handler(s *NServer, request *Message) error {
-	ns, outGoingRequest := processRequest(
+	ns, outGoingRequest := ProcessRequest(
 		Server{
 			Id:                     s.Id,
 			NumberOfServers:        uint64(len(s.Peers)),
 			UnsatisfiedRequests:    s.UnsatisfiedRequests,
+			ForwardedRequests:      s.ForwardedRequests,
+			ForwardedReplies:       s.ForwardedReplies,
+			ForwardTimeout:         s.ForwardTimeout,
 			VectorClock:            s.VectorClock,
 			OperationsPerformed:    s.OperationsPerformed,
 			MyOperations:           s.MyOperations,
+			MyOperationsOffset:     s.MyOperationsOffset,
 			PendingOperations:      s.PendingOperations,
+			KeyValueStore:          s.KeyValueStore,
+			StableVersionVector:    s.StableVersionVector,
+			AnnouncedStableVector:  s.AnnouncedStableVector,
+			SnapshotVersionVector:  s.SnapshotVersionVector,
 			GossipAcknowledgements: s.GossipAcknowledgements,
+			GossipSentIndex:        s.GossipSentIndex,
+			GossipUnackedTicks:     s.GossipUnackedTicks,
+			GossipRetransmitTicks:  s.GossipRetransmitTicks,
+			SnapshotThreshold:      s.SnapshotThreshold,
+			PeerVectorClocks:       s.PeerVectorClocks,
+			UnsatisfiedPolicy:      s.UnsatisfiedPolicy,
+			Neighbours:             s.Neighbours,
+			Relay:                  s.Relay,
+			GossipSentVectors:      s.GossipSentVectors,
+			GossipStreaming:        s.GossipStreaming,
+			Epoch:                  s.Epoch,
+			PeerEpochs:             s.PeerEpochs,
+			PendingSnapshots:       s.PendingSnapshots,
+			RecoveryWaiting:        s.RecoveryWaiting,
+			RecoveryTarget:         s.RecoveryTarget,
+			GossipMaxOperations:    s.GossipMaxOperations,
+			GossipMaxBytes:         s.GossipMaxBytes,
+			MaxKeySize:             s.MaxKeySize,
+			MaxValueSize:           s.MaxValueSize,
+			Now:                    uint64(time.Now().UnixMicro()),
+			Journal:                s.Journal,
 		}, *request)
 
 	s.UnsatisfiedRequests = ns.UnsatisfiedRequests
+	s.ForwardedRequests = ns.ForwardedRequests
+	s.ForwardedReplies = ns.ForwardedReplies
 	s.VectorClock = ns.VectorClock
 	s.OperationsPerformed = ns.OperationsPerformed
 	s.MyOperations = ns.MyOperations
+	s.MyOperationsOffset = ns.MyOperationsOffset
 	s.PendingOperations = ns.PendingOperations
+	s.KeyValueStore = ns.KeyValueStore
+	s.StableVersionVector = ns.StableVersionVector
+	s.AnnouncedStableVector = ns.AnnouncedStableVector
+	s.SnapshotVersionVector = ns.SnapshotVersionVector
 	s.GossipAcknowledgements = ns.GossipAcknowledgements
+	s.GossipSentIndex = ns.GossipSentIndex
+	s.GossipUnackedTicks = ns.GossipUnackedTicks
+	s.GossipStreaming = ns.GossipStreaming
+	s.PeerEpochs = ns.PeerEpochs
+	s.PendingSnapshots = ns.PendingSnapshots
+	s.RecoveryWaiting = ns.RecoveryWaiting
+	s.RecoveryTarget = ns.RecoveryTarget
+	s.PeerVectorClocks = ns.PeerVectorClocks
+	s.GossipSentVectors = ns.GossipSentVectors
+	s.GossipSentOperations = ns.GossipSentOperations
+	s.Journal = ns.Journal[:0]
+
+	if s.storage != nil {
+		err := s.storage.append(ns.Journal)
+		if err != nil {
+			fmt.Println(err)
+		}
+		if ns.InstalledSnapshot {
+			err = s.storage.snapshot(s)
+			if err != nil {
+				fmt.Println(err)
+			}
+		}
+	}
 
 	go func() {
 		i := uint64(0)
@@ -416,20 +1545,23 @@ func handler(s *NServer, request *Message) error {
 		for i < l {
 			index := i
 			if outGoingRequest[index].MessageType == 1 {
-				c, _ := s.PeerConnection.Load(outGoingRequest[index].S2S_Gossip_Receiving_ServerId)
-				err := c.(*gob.Encoder).Encode(&outGoingRequest[index])
-				if err != nil {
-					fmt.Println(err)
-				}
+				sendToPeer(s, &s.PeerConnection, outGoingRequest[index].S2S_Gossip_Receiving_ServerId, &outGoingRequest[index])
+			} else if outGoingRequest[index].MessageType == 5 {
+				sendToPeer(s, &s.PeerConnection, outGoingRequest[index].S2S_Snapshot_Receiving_ServerId, &outGoingRequest[index])
+			} else if outGoingRequest[index].MessageType == 9 {
+				sendToPeer(s, &s.PeerConnection, outGoingRequest[index].S2S_AntiEntropy_Receiving_ServerId, &outGoingRequest[index])
+			} else if outGoingRequest[index].MessageType == 7 || outGoingRequest[index].MessageType == 8 ||
+				outGoingRequest[index].MessageType == 11 {
+				sendToPeer(s, &s.PeerConnection, outGoingRequest[index].S2S_Forward_Receiving_ServerId, &outGoingRequest[index])
 			} else if outGoingRequest[index].MessageType == 2 {
-				c, _ := s.PeerAckConnection.Load(outGoingRequest[index].S2S_Acknowledge_Gossip_Receiving_ServerId)
-				err := c.(*gob.Encoder).Encode(&outGoingRequest[index])
-				if err != nil {
-					fmt.Println(err)
-				}
+				sendToPeer(s, &s.PeerAckConnection, outGoingRequest[index].S2S_Acknowledge_Gossip_Receiving_ServerId, &outGoingRequest[index])
 			} else if outGoingRequest[index].MessageType == 4 {
-				c, _ := s.Clients.Load(outGoingRequest[index].S2C_Client_Number)
-				err := c.(*gob.Encoder).Encode(&outGoingRequest[index])
+				c, ok := s.Clients.Load(outGoingRequest[index].S2C_Client_Number)
+				if !ok {
+					i++
+					continue
+				}
+				err := c.(Conn).Send(&outGoingRequest[index])
 				if err != nil {
 					fmt.Println(err)
 				}
@@ -441,8 +1573,83 @@ func handler(s *NServer, request *Message) error {
 	return nil
 }
 
+// A connection to a peer that has restarted is broken, so it is dialed again
+// and the message sent on the new connection.
+func sendToPeer(s *NServer, connections *sync.Map, peer uint64, m *Message) {
+	c, ok := connections.Load(peer)
+	if !ok {
+		return
+	}
+	err := c.(Conn).Send(m)
+	if err == nil {
+		return
+	}
+	fmt.Println(err)
+
+	d, err := s.Transport.Dial(s.Peers[peer])
+	if err != nil {
+		return
+	}
+	if !connections.CompareAndSwap(peer, c, d) {
+		d.Close()
+		return
+	}
+	c.(Conn).Close()
+	err = d.Send(m)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+// pickGossipTargets chooses fanout of the neighbours at random, or returns nil
+// to gossip to all of them.
+func pickGossipTargets(neighbours []uint64, fanout uint64) []uint64 {
+	if fanout == 0 || fanout >= uint64(len(neighbours)) {
+		return nil
+	}
+	var targets = make([]uint64, 0, fanout)
+	for _, i := range rand.Perm(len(neighbours))[:fanout] {
+		targets = append(targets, neighbours[i])
+	}
+	return targets
+}
+
 func Start(s *NServer) error {
-	l, err := net.Listen(s.Self.Network, s.Self.Address)
+	if s.DataDirectory != "" {
+		err := recoverFromStorage(s)
+		if err != nil {
+			fmt.Println(err)
+			return err
+		}
+		go func() {
+			for {
+				time.Sleep(time.Duration(s.SyncInterval) * time.Millisecond)
+
+				s.mu.Lock()
+				err := s.storage.sync()
+				s.mu.Unlock()
+				if err != nil {
+					fmt.Println(err)
+				}
+			}
+		}()
+		go func() {
+			for {
+				time.Sleep(time.Duration(s.SnapshotInterval) * time.Millisecond)
+
+				s.mu.Lock()
+				err := s.storage.snapshot(s)
+				s.mu.Unlock()
+				if err != nil {
+					fmt.Println(err)
+				}
+			}
+		}()
+	} else {
+		waitForRecovery(s)
+	}
+
+	l, err := s.Transport.Listen(s.Self)
 
 	if err != nil {
 		fmt.Println(err)
@@ -454,13 +1661,12 @@ func Start(s *NServer) error {
 		for i < uint64(len(s.Peers)) {
 			if i != s.Id {
 				for {
-					c, err := net.Dial(s.Peers[i].Network, s.Peers[i].Address)
+					c, err := s.Transport.Dial(s.Peers[i])
 					if err != nil {
 						continue
 					}
 					s.mu.Lock()
-					enc := gob.NewEncoder(c)
-					s.PeerConnection.Store(i, enc)
+					s.PeerConnection.Store(i, c)
 					s.mu.Unlock()
 
 					break
@@ -476,13 +1682,27 @@ func Start(s *NServer) error {
 		for i < uint64(len(s.Peers)) {
 			if i != s.Id {
 				for {
-					c, err := net.Dial(s.Peers[i].Network, s.Peers[i].Address)
+					c, err := s.Transport.Dial(s.Peers[i])
 					if err != nil {
 						continue
 					}
 					s.mu.Lock()
-					enc := gob.NewEncoder(c)
-					s.PeerAckConnection.Store(i, enc)
+					s.PeerAckConnection.Store(i, c)
+
+					// Telling the peer how much of its log we have lets it
+					// notice that we restarted behind and send us a snapshot.
+					ack := Message{MessageType: 2,
+						S2S_Acknowledge_Gossip_Sending_ServerId:   s.Id,
+						S2S_Acknowledge_Gossip_Receiving_ServerId: i,
+						S2S_Acknowledge_Gossip_Index:              s.VectorClock[i],
+						S2S_Acknowledge_Gossip_VectorClock:        append([]uint64(nil), s.VectorClock...),
+						S2S_Acknowledge_Gossip_Epoch:              s.Epoch,
+						S2S_Acknowledge_Gossip_Recovering:         i < uint64(len(s.RecoveryWaiting)) && s.RecoveryWaiting[i],
+					}
+					err = c.Send(&ack)
+					if err != nil {
+						fmt.Println(err)
+					}
 					s.mu.Unlock()
 
 					break
@@ -494,26 +1714,44 @@ func Start(s *NServer) error {
 	}()
 
 	go func() error {
+		interval := s.GossipInterval
 		for {
-			ms := s.GossipInterval + uint64((rand.IntN(500)))
+			ms := interval
+			if s.GossipJitter != 0 {
+				ms += rand.Uint64N(s.GossipJitter)
+			}
 
 			time.Sleep(time.Duration(ms) * time.Microsecond)
 
 			s.mu.Lock()
 
-			if len(s.MyOperations) == 0 {
-				s.mu.Unlock()
-				continue
-			}
-
-			request := Message{MessageType: 3}
+			request := Message{MessageType: 3, S2S_Gossip_Targets: pickGossipTargets(s.Neighbours, s.GossipFanout)}
 
 			handler(s, &request)
+			interval = NextGossipInterval(interval, s.GossipMinInterval, s.GossipMaxInterval, s.GossipSentOperations)
 
 			s.mu.Unlock()
 		}
 	}()
 
+	if s.AntiEntropyInterval != 0 && len(s.Peers) > 1 {
+		go func() {
+			for {
+				time.Sleep(time.Duration(s.AntiEntropyInterval) * time.Millisecond)
+
+				peer := uint64(rand.IntN(len(s.Peers) - 1))
+				if peer >= s.Id {
+					peer++
+				}
+
+				s.mu.Lock()
+				request := Message{MessageType: 10, S2S_AntiEntropy_Receiving_ServerId: peer}
+				handler(s, &request)
+				s.mu.Unlock()
+			}
+		}()
+	}
+
 	for {
 		conn, err := l.Accept()
 		if err != nil {
@@ -521,15 +1759,22 @@ func Start(s *NServer) error {
 			return nil
 		}
 
-		go func(s *NServer, c net.Conn) error {
-			dec := gob.NewDecoder(c)
-
+		go func(s *NServer, c Conn) error {
+			clients := make([]uint64, 0)
 			for {
 				m := Message{}
-				err := dec.Decode(&m)
+				err := c.Receive(&m)
 				if err != nil {
 					fmt.Print(err)
 					c.Close()
+
+					// A client that reconnects, or another session that
+					// picks the same id, has stored its own connection.
+					s.mu.Lock()
+					for _, id := range clients {
+						s.Clients.CompareAndDelete(id, c)
+					}
+					s.mu.Unlock()
 					return err
 				}
 
@@ -537,8 +1782,8 @@ func Start(s *NServer) error {
 				if m.MessageType == 0 {
 					_, ok := s.Clients.Load(m.C2S_Client_Id)
 					if !ok {
-						enc := gob.NewEncoder(c)
-						s.Clients.Store(m.C2S_Client_Id, enc)
+						s.Clients.Store(m.C2S_Client_Id, c)
+						clients = append(clients, m.C2S_Client_Id)
 					}
 				}
 
@@ -0,0 +1,394 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alanwang67/session_semantics/protocol"
+)
+
+// A client request whose version vector is not one entry per server is turned
+// away instead of being compared entry by entry.
+func TestRequestWithWrongVectorLength(t *testing.T) {
+	s := NewState(0, 3)
+	for _, vectorClock := range [][]uint64{nil, {0, 0}, {0, 0, 0, 0}} {
+		for _, operationType := range []uint64{0, 1} {
+			_, replies := ProcessRequest(s, Message{MessageType: 0,
+				C2S_Client_Id:            1,
+				C2S_Client_OperationType: operationType,
+				C2S_Client_Key:           []byte("k"),
+				C2S_Client_VersionVector: vectorClock,
+			})
+			if len(replies) != 1 || replies[0].S2C_Client_Status != StatusBadVector {
+				t.Fatalf("vector %v: got replies %+v", vectorClock, replies)
+			}
+		}
+	}
+}
+
+func messagesOfType(messages []Message, messageType uint64) []Message {
+	var matching = make([]Message, 0)
+	for _, m := range messages {
+		if m.MessageType == messageType {
+			matching = append(matching, m)
+		}
+	}
+	return matching
+}
+
+// A forwarded request that goes unanswered is sent again after ForwardTimeout,
+// the peer serves it only once however many copies reach it, and only the
+// first reply goes back to the client.
+func TestForwardedRequestIsRetransmittedAndServedOnce(t *testing.T) {
+	s0 := NewState(0, 3)
+	s0.UnsatisfiedPolicy = UnsatisfiedForward
+	s0.PeerVectorClocks[1] = []uint64{0, 1, 0}
+	s1 := NewState(1, 3)
+	s1.VectorClock = []uint64{0, 1, 0}
+
+	s0, out := ProcessRequest(s0, Message{MessageType: 0,
+		C2S_Client_Id:            4,
+		C2S_Client_RequestId:     9,
+		C2S_Client_OperationType: 1,
+		C2S_Client_Key:           []byte("k"),
+		C2S_Client_Data:          []byte("v"),
+		C2S_Client_VersionVector: []uint64{0, 1, 0},
+	})
+	forwards := messagesOfType(out, 7)
+	if len(forwards) != 1 || forwards[0].S2S_Forward_Receiving_ServerId != 1 {
+		t.Fatalf("forwarded %+v", out)
+	}
+
+	s0.Now = s0.ForwardTimeout - 1
+	s0, out = ProcessRequest(s0, Message{MessageType: 3})
+	if len(messagesOfType(out, 7)) != 0 {
+		t.Fatal("forwarded request was sent again before its timeout")
+	}
+	s0.Now = s0.ForwardTimeout
+	s0, out = ProcessRequest(s0, Message{MessageType: 3})
+	retransmitted := messagesOfType(out, 7)
+	if len(retransmitted) != 1 || !sameClientRequest(retransmitted[0], forwards[0]) {
+		t.Fatalf("forwarded request was not sent again: %+v", out)
+	}
+
+	var replies = make([]Message, 0)
+	for _, forward := range []Message{forwards[0], retransmitted[0]} {
+		s1, out = ProcessRequest(s1, forward)
+		replies = append(replies, messagesOfType(out, 8)...)
+	}
+	if s1.VectorClock[1] != 2 || len(s1.MyOperations) != 1 {
+		t.Fatalf("peer served the request to vector clock %v with %d operations", s1.VectorClock, len(s1.MyOperations))
+	}
+	if len(replies) != 2 || !equalSlices(replies[0].S2C_Client_VersionVector, replies[1].S2C_Client_VersionVector) {
+		t.Fatalf("peer replied %+v", replies)
+	}
+
+	var relayed = 0
+	for _, reply := range replies {
+		s0, out = ProcessRequest(s0, reply)
+		relayed += len(messagesOfType(out, 4))
+	}
+	if relayed != 1 || len(s0.ForwardedRequests) != 0 {
+		t.Fatalf("relayed %d replies with %d requests still forwarded", relayed, len(s0.ForwardedRequests))
+	}
+}
+
+// A peer that restarts behind has forgotten the request, so after the timeout
+// the request is parked where the client sent it.
+func TestForwardedRequestIsParkedWhenPeerRestarts(t *testing.T) {
+	s0 := NewState(0, 3)
+	s0.UnsatisfiedPolicy = UnsatisfiedForward
+	s0.PeerVectorClocks[1] = []uint64{0, 1, 0}
+
+	s0, _ = ProcessRequest(s0, Message{MessageType: 0,
+		C2S_Client_Id:            4,
+		C2S_Client_RequestId:     9,
+		C2S_Client_VersionVector: []uint64{0, 1, 0},
+	})
+	s0, _ = ProcessRequest(s0, Message{MessageType: 2,
+		S2S_Acknowledge_Gossip_Sending_ServerId:   1,
+		S2S_Acknowledge_Gossip_Receiving_ServerId: 0,
+		S2S_Acknowledge_Gossip_VectorClock:        []uint64{0, 0, 0},
+		S2S_Acknowledge_Gossip_Epoch:              2,
+	})
+
+	s0.Now = s0.ForwardTimeout
+	s0, out := ProcessRequest(s0, Message{MessageType: 3})
+	if len(messagesOfType(out, 7)) != 0 || len(s0.ForwardedRequests) != 0 || len(s0.UnsatisfiedRequests) != 1 {
+		t.Fatalf("sent %+v, %d forwarded, %d parked", out, len(s0.ForwardedRequests), len(s0.UnsatisfiedRequests))
+	}
+
+	s0, out = ProcessRequest(s0, Message{MessageType: 1,
+		S2S_Gossip_Sending_ServerId:   1,
+		S2S_Gossip_Receiving_ServerId: 0,
+		S2S_Gossip_Operations:         []Operation{{VersionVector: []uint64{0, 1, 0}, Key: []byte("k"), Data: []byte("v")}},
+		S2S_Gossip_VectorClock:        []uint64{0, 1, 0},
+		S2S_Gossip_Epoch:              2,
+	})
+	served := messagesOfType(out, 4)
+	if len(served) != 1 || served[0].S2C_Client_RequestId != 9 {
+		t.Fatalf("parked request was not served: %+v", out)
+	}
+}
+
+// A client's connection is forgotten once it fails, so sessions that come and
+// go do not leave closed connections behind.
+func TestClosedClientConnectionIsForgotten(t *testing.T) {
+	transport := NewMemoryTransport()
+	peers := []*protocol.Connection{{Network: "memory", Address: "server-0"}}
+	s := New(0, peers[0], peers, 1000)
+	s.Transport = transport
+	go Start(s)
+
+	var c Conn
+	var err error
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c, err = transport.Dial(peers[0])
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	err = c.Send(&Message{MessageType: 0, C2S_Client_Id: 7, C2S_Client_RequestId: 1, C2S_Client_VersionVector: []uint64{0}})
+	if err == nil {
+		err = c.Receive(&Message{})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Clients.Load(uint64(7)); !ok {
+		t.Fatal("client connection was not stored")
+	}
+
+	c.Close()
+	for {
+		if _, ok := s.Clients.Load(uint64(7)); !ok {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("closed client connection was kept")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func writeTo(t *testing.T, s Server, keys ...string) Server {
+	for _, key := range keys {
+		var out []Message
+		s, out = ProcessRequest(s, Message{MessageType: 0,
+			C2S_Client_Id:            1,
+			C2S_Client_RequestId:     s.VectorClock[s.Id],
+			C2S_Client_OperationType: 1,
+			C2S_Client_Key:           []byte(key),
+			C2S_Client_Data:          []byte("value-" + key),
+			C2S_Client_VersionVector: make([]uint64, s.NumberOfServers),
+		})
+		if len(messagesOfType(out, 4)) != 1 {
+			t.Fatalf("write of %q was not served: %+v", key, out)
+		}
+	}
+	return s
+}
+
+// Gossip messages that carry operations.
+func gossipWithOperations(messages []Message) []Message {
+	var gossip = make([]Message, 0)
+	for _, m := range messagesOfType(messages, 1) {
+		if len(m.S2S_Gossip_Operations) != 0 {
+			gossip = append(gossip, m)
+		}
+	}
+	return gossip
+}
+
+// Gossip that is never acknowledged is sent again after GossipRetransmitTicks
+// ticks, and an acknowledgement stops it from being sent again.
+func TestUnacknowledgedGossipIsRetransmitted(t *testing.T) {
+	s := NewState(0, 2)
+	s.GossipRetransmitTicks = 3
+	s, _ = ProcessRequest(s, Message{MessageType: 2,
+		S2S_Acknowledge_Gossip_Sending_ServerId:   1,
+		S2S_Acknowledge_Gossip_Receiving_ServerId: 0,
+		S2S_Acknowledge_Gossip_VectorClock:        []uint64{0, 0},
+		S2S_Acknowledge_Gossip_Epoch:              1,
+	})
+	s = writeTo(t, s, "a", "b")
+
+	var out []Message
+	s, out = ProcessRequest(s, Message{MessageType: 3})
+	sent := gossipWithOperations(out)
+	if len(sent) != 1 || len(sent[0].S2S_Gossip_Operations) != 2 {
+		t.Fatalf("first tick sent %+v", out)
+	}
+
+	// The gossip is lost, so nothing comes back.
+	var i = uint64(1)
+	for i < s.GossipRetransmitTicks {
+		s, out = ProcessRequest(s, Message{MessageType: 3})
+		if len(gossipWithOperations(out)) != 0 {
+			t.Fatalf("tick %d sent the gossip again before the retransmit timeout", i)
+		}
+		i++
+	}
+	s, out = ProcessRequest(s, Message{MessageType: 3})
+	resent := gossipWithOperations(out)
+	if len(resent) != 1 || len(resent[0].S2S_Gossip_Operations) != 2 {
+		t.Fatalf("tick %d did not send the gossip again: %+v", s.GossipRetransmitTicks, out)
+	}
+
+	s, _ = ProcessRequest(s, Message{MessageType: 2,
+		S2S_Acknowledge_Gossip_Sending_ServerId:   1,
+		S2S_Acknowledge_Gossip_Receiving_ServerId: 0,
+		S2S_Acknowledge_Gossip_Index:              2,
+		S2S_Acknowledge_Gossip_VectorClock:        []uint64{2, 0},
+		S2S_Acknowledge_Gossip_Epoch:              1,
+	})
+	if s.GossipAcknowledgements[1] != 2 {
+		t.Fatalf("acknowledgement advanced to %d, want 2", s.GossipAcknowledgements[1])
+	}
+	i = uint64(0)
+	for i < 2*s.GossipRetransmitTicks {
+		s, out = ProcessRequest(s, Message{MessageType: 3})
+		if len(gossipWithOperations(out)) != 0 {
+			t.Fatalf("acknowledged gossip was sent again: %+v", out)
+		}
+		i++
+	}
+}
+
+// A server that is behind asks a peer for what it is missing, and the peer
+// answers with exactly those operations in an order they can be applied in.
+// A server that is not behind gets nothing back.
+func TestAntiEntropyPullsMissingOperations(t *testing.T) {
+	s0 := writeTo(t, NewState(0, 3), "a")
+	first := s0.MyOperations[0]
+	s0, _ = ProcessRequest(s0, Message{MessageType: 1,
+		S2S_Gossip_Sending_ServerId:   2,
+		S2S_Gossip_Receiving_ServerId: 0,
+		S2S_Gossip_Operations:         []Operation{{VersionVector: []uint64{0, 0, 1}, Key: []byte("c"), Data: []byte("value-c")}},
+		S2S_Gossip_VectorClock:        []uint64{0, 0, 1},
+		S2S_Gossip_Epoch:              1,
+	})
+	s0 = writeTo(t, s0, "b", "a")
+
+	s1 := NewState(1, 3)
+	s1, _ = ProcessRequest(s1, Message{MessageType: 1,
+		S2S_Gossip_Sending_ServerId:   0,
+		S2S_Gossip_Receiving_ServerId: 1,
+		S2S_Gossip_Operations:         []Operation{first},
+		S2S_Gossip_VectorClock:        []uint64{1, 0, 0},
+		S2S_Gossip_Epoch:              1,
+	})
+
+	s1, out := ProcessRequest(s1, Message{MessageType: 10, S2S_AntiEntropy_Receiving_ServerId: 0})
+	requests := messagesOfType(out, 9)
+	if len(requests) != 1 || requests[0].S2S_AntiEntropy_Receiving_ServerId != 0 ||
+		!equalSlices(requests[0].S2S_AntiEntropy_VectorClock, []uint64{1, 0, 0}) {
+		t.Fatalf("anti-entropy tick sent %+v", out)
+	}
+
+	_, out = ProcessRequest(s0, requests[0])
+	replies := messagesOfType(out, 1)
+	if len(replies) != 1 {
+		t.Fatalf("peer answered %+v", out)
+	}
+	var want = [][]uint64{{0, 0, 1}, {2, 0, 1}, {3, 0, 1}}
+	operations := replies[0].S2S_Gossip_Operations
+	if len(operations) != len(want) {
+		t.Fatalf("peer sent %d operations, want %d", len(operations), len(want))
+	}
+	for i, operation := range operations {
+		if !equalSlices(operation.VersionVector, want[i]) {
+			t.Fatalf("operation %d has version vector %v, want %v", i, operation.VersionVector, want[i])
+		}
+	}
+
+	s1, _ = ProcessRequest(s1, replies[0])
+	if !equalSlices(s1.VectorClock, s0.VectorClock) || len(s1.PendingOperations) != 0 {
+		t.Fatalf("requester reached %v with %d pending, want %v", s1.VectorClock, len(s1.PendingOperations), s0.VectorClock)
+	}
+
+	for _, vectorClock := range [][]uint64{s0.VectorClock, {4, 0, 1}} {
+		_, out = ProcessRequest(s0, Message{MessageType: 9,
+			S2S_AntiEntropy_Sending_ServerId:   1,
+			S2S_AntiEntropy_Receiving_ServerId: 0,
+			S2S_AntiEntropy_VectorClock:        vectorClock,
+		})
+		if len(out) != 0 {
+			t.Fatalf("requester at %v was sent %+v", vectorClock, out)
+		}
+	}
+}
+
+// A backlog over GossipMaxOperations goes out in several messages, the next
+// one as soon as the previous one is acknowledged.
+func TestGossipOverTheLimitIsSplit(t *testing.T) {
+	s := NewState(0, 2)
+	s.GossipMaxOperations = 2
+	s = writeTo(t, s, "a", "b", "c", "d", "e")
+
+	s, out := ProcessRequest(s, Message{MessageType: 3})
+	var sizes = make([]int, 0)
+	var received = uint64(0)
+	for {
+		gossip := gossipWithOperations(out)
+		if len(gossip) == 0 {
+			break
+		}
+		if len(gossip) != 1 {
+			t.Fatalf("sent %d gossip messages at once", len(gossip))
+		}
+		sizes = append(sizes, len(gossip[0].S2S_Gossip_Operations))
+		received += uint64(len(gossip[0].S2S_Gossip_Operations))
+		s, out = ProcessRequest(s, Message{MessageType: 2,
+			S2S_Acknowledge_Gossip_Sending_ServerId:   1,
+			S2S_Acknowledge_Gossip_Receiving_ServerId: 0,
+			S2S_Acknowledge_Gossip_Index:              received,
+			S2S_Acknowledge_Gossip_VectorClock:        []uint64{received, 0},
+		})
+	}
+	if len(sizes) != 3 || sizes[0] != 2 || sizes[1] != 2 || sizes[2] != 1 {
+		t.Fatalf("sent batches of %v operations, want [2 2 1]", sizes)
+	}
+
+	s.GossipMaxOperations = 0
+	s.GossipMaxBytes = 1
+	operations, truncated := limitGossipOperations(s, s.MyOperations)
+	if len(operations) != 1 || !truncated {
+		t.Fatalf("a byte limit smaller than one operation let %d through", len(operations))
+	}
+}
+
+// A snapshot is split into chunks like gossip, and the receiver installs none
+// of it until every chunk has arrived, in whatever order they come.
+func TestSnapshotIsInstalledAfterLastChunk(t *testing.T) {
+	s0 := NewState(0, 2)
+	s0.GossipMaxOperations = 2
+	s0 = writeTo(t, s0, "a", "b", "c", "d", "e")
+
+	chunks := getSnapshotMessages(s0, 1)
+	if len(chunks) != 3 {
+		t.Fatalf("snapshot of 5 keys was split into %d chunks, want 3", len(chunks))
+	}
+
+	s1 := NewState(1, 2)
+	for i := len(chunks) - 1; i >= 0; i-- {
+		s1, _ = ProcessRequest(s1, chunks[i])
+		if i != 0 && (s1.VectorClock[0] != 0 || len(s1.KeyValueStore) != 0) {
+			t.Fatalf("installed part of the snapshot with %d chunks missing", i)
+		}
+	}
+	if !equalSlices(s1.VectorClock, s0.VectorClock) || len(s1.KeyValueStore) != 5 {
+		t.Fatalf("installed snapshot to %v with %d keys, want %v with 5", s1.VectorClock, len(s1.KeyValueStore), s0.VectorClock)
+	}
+	for key, operation := range s0.KeyValueStore {
+		if string(s1.KeyValueStore[key].Data) != string(operation.Data) {
+			t.Fatalf("key %q has %q, want %q", key, s1.KeyValueStore[key].Data, operation.Data)
+		}
+	}
+}
@@ -0,0 +1,309 @@
+package server
+
+import (
+	"bufio"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// SyncPerOperation makes every operation durable before it is acknowledged.
+// Under SyncBatched and SyncNone a crash can lose writes that peers already
+// have, and a server without a DataDirectory loses all of them, so such a
+// server does not accept writes after it starts until every peer has told it
+// how many of its operations it holds and it has pulled them back; otherwise
+// it would reuse their sequence numbers. Until then it still serves reads, but
+// it cannot take writes while a peer is down.
+const (
+	SyncPerOperation = uint64(0)
+	SyncBatched      = uint64(1)
+	SyncNone         = uint64(2)
+)
+
+type Snapshot struct {
+	VectorClock           []uint64
+	OperationsPerformed   []Operation
+	MyOperations          []Operation
+	MyOperationsOffset    uint64
+	KeyValueStore         map[string]Operation
+	StableVersionVector   []uint64
+	SnapshotVersionVector []uint64
+}
+
+// storage is an append-only log of every operation the server applies. The
+// log is replaced by a snapshot of the server's state every SnapshotInterval
+// milliseconds, so recovery is the latest snapshot followed by the log.
+type storage struct {
+	directory string
+	policy    uint64
+	file      *os.File
+	writer    *bufio.Writer
+	encoder   *gob.Encoder
+	dirty     bool
+}
+
+func (st *storage) logPath() string {
+	return filepath.Join(st.directory, "wal")
+}
+
+func (st *storage) snapshotPath() string {
+	return filepath.Join(st.directory, "snapshot")
+}
+
+func (st *storage) append(records []LogRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	var i = uint64(0)
+	for i < uint64(len(records)) {
+		err := st.encoder.Encode(&records[i])
+		if err != nil {
+			return err
+		}
+		i++
+	}
+
+	err := st.writer.Flush()
+	if err != nil {
+		return err
+	}
+
+	if st.policy == SyncPerOperation {
+		return st.file.Sync()
+	}
+	st.dirty = true
+	return nil
+}
+
+func (st *storage) sync() error {
+	if !st.dirty || st.policy != SyncBatched {
+		return nil
+	}
+	st.dirty = false
+	return st.file.Sync()
+}
+
+func syncDirectory(directory string) error {
+	d, err := os.Open(directory)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// The snapshot is written to a temporary file and renamed into place before
+// the log is truncated, so a crash at any point leaves either the old snapshot
+// and the full log or the new snapshot and a log that replays as a no-op.
+func (st *storage) snapshot(s *NServer) error {
+	tmp := st.snapshotPath() + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	err = gob.NewEncoder(w).Encode(&Snapshot{
+		VectorClock:           s.VectorClock,
+		OperationsPerformed:   s.OperationsPerformed,
+		MyOperations:          s.MyOperations,
+		MyOperationsOffset:    s.MyOperationsOffset,
+		KeyValueStore:         s.KeyValueStore,
+		StableVersionVector:   s.StableVersionVector,
+		SnapshotVersionVector: s.SnapshotVersionVector,
+	})
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmp, st.snapshotPath())
+	if err != nil {
+		return err
+	}
+	err = syncDirectory(st.directory)
+	if err != nil {
+		return err
+	}
+
+	if st.file != nil {
+		st.file.Close()
+	}
+	st.file, err = os.Create(st.logPath())
+	if err != nil {
+		return err
+	}
+	st.writer = bufio.NewWriter(st.file)
+	st.encoder = gob.NewEncoder(st.writer)
+	st.dirty = false
+
+	return st.file.Sync()
+}
+
+func replayLogRecord(server Server, record LogRecord) Server {
+	if compareVersionVector(server.VectorClock, record.Operation.VersionVector) {
+		return server
+	}
+	return applyLoggedOperation(server, record.Operation, record.Own)
+}
+
+func recovering(server Server) bool {
+	for _, waiting := range server.RecoveryWaiting {
+		if waiting {
+			return true
+		}
+	}
+	return server.VectorClock[server.Id] < server.RecoveryTarget
+}
+
+// A recovering server learns from every message that carries a peer's vector
+// clock how many of its own operations the peer holds, and asks the peer for
+// the ones it lost through anti-entropy. Once it has heard from every peer and
+// caught up with all of them it takes the writes it held back.
+func observeRecoveryClock(server Server, peer uint64, vectorClock []uint64) (Server, []Message) {
+	if !recovering(server) || peer >= server.NumberOfServers || peer == server.Id ||
+		uint64(len(vectorClock)) != server.NumberOfServers {
+		return server, nil
+	}
+
+	server.RecoveryWaiting = append([]bool(nil), server.RecoveryWaiting...)
+	if peer < uint64(len(server.RecoveryWaiting)) {
+		server.RecoveryWaiting[peer] = false
+	}
+	server.RecoveryTarget = maxTwoInts(server.RecoveryTarget, vectorClock[server.Id])
+
+	if vectorClock[server.Id] > server.VectorClock[server.Id] {
+		return server, []Message{{MessageType: 9,
+			S2S_AntiEntropy_Sending_ServerId:   server.Id,
+			S2S_AntiEntropy_Receiving_ServerId: peer,
+			S2S_AntiEntropy_VectorClock:        append([]uint64(nil), server.VectorClock...),
+		}}
+	}
+	if !recovering(server) {
+		return processUnsatisfiedRequests(server)
+	}
+	return server, nil
+}
+
+// Until a peer answers, every gossip tick asks it again for its vector clock.
+func getRecoveryAcknowledgements(server Server) []Message {
+	var messages = make([]Message, 0)
+	var i = uint64(0)
+	for i < uint64(len(server.RecoveryWaiting)) {
+		if server.RecoveryWaiting[i] {
+			messages = append(messages, getGossipAcknowledgement(server, i))
+		}
+		i++
+	}
+	return messages
+}
+
+func waitForRecovery(s *NServer) {
+	s.RecoveryWaiting = make([]bool, len(s.Peers))
+	var i = uint64(0)
+	for i < uint64(len(s.RecoveryWaiting)) {
+		s.RecoveryWaiting[i] = i != s.Id
+		i++
+	}
+}
+
+func recoverFromStorage(s *NServer) error {
+	err := os.MkdirAll(s.DataDirectory, 0o755)
+	if err != nil {
+		return err
+	}
+
+	st := &storage{directory: s.DataDirectory, policy: s.SyncPolicy}
+
+	f, err := os.Open(st.snapshotPath())
+	if err == nil {
+		snapshot := Snapshot{}
+		err = gob.NewDecoder(bufio.NewReader(f)).Decode(&snapshot)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		s.VectorClock = snapshot.VectorClock
+		s.OperationsPerformed = snapshot.OperationsPerformed
+		s.MyOperations = snapshot.MyOperations
+		s.MyOperationsOffset = snapshot.MyOperationsOffset
+		s.KeyValueStore = snapshot.KeyValueStore
+		s.StableVersionVector = snapshot.StableVersionVector
+		s.AnnouncedStableVector = append([]uint64(nil), snapshot.StableVersionVector...)
+		if snapshot.SnapshotVersionVector != nil {
+			s.SnapshotVersionVector = snapshot.SnapshotVersionVector
+		}
+		if s.KeyValueStore == nil {
+			s.KeyValueStore = make(map[string]Operation)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	f, err = os.Open(st.logPath())
+	if err == nil {
+		ns := Server{
+			Id:                  s.Id,
+			NumberOfServers:     uint64(len(s.Peers)),
+			VectorClock:         s.VectorClock,
+			OperationsPerformed: s.OperationsPerformed,
+			MyOperations:        s.MyOperations,
+			MyOperationsOffset:  s.MyOperationsOffset,
+			KeyValueStore:       s.KeyValueStore,
+		}
+
+		// A torn record at the end of the log was never synced, so replay stops
+		// at the first record that fails to decode.
+		dec := gob.NewDecoder(bufio.NewReader(f))
+		for {
+			record := LogRecord{}
+			err = dec.Decode(&record)
+			if err != nil {
+				break
+			}
+			ns = replayLogRecord(ns, record)
+		}
+		f.Close()
+		if err != io.EOF {
+			fmt.Println("stopped replaying log:", err)
+		}
+
+		s.VectorClock = ns.VectorClock
+		s.OperationsPerformed = ns.OperationsPerformed
+		s.MyOperations = ns.MyOperations
+		s.KeyValueStore = ns.KeyValueStore
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	// Everything before MyOperationsOffset is stable, so every peer is known
+	// to have at least that much of our log.
+	var i = uint64(0)
+	for i < uint64(len(s.GossipAcknowledgements)) {
+		s.GossipAcknowledgements[i] = s.MyOperationsOffset
+		s.GossipSentIndex[i] = s.MyOperationsOffset
+		i++
+	}
+
+	if s.SyncPolicy != SyncPerOperation {
+		waitForRecovery(s)
+	}
+
+	err = st.snapshot(s)
+	if err != nil {
+		return err
+	}
+	s.storage = st
+
+	return nil
+}
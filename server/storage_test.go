@@ -0,0 +1,277 @@
+package server
+
+import (
+	"bytes"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/alanwang67/session_semantics/protocol"
+)
+
+func newStorageServer(t *testing.T, id uint64, n uint64, directory string, policy uint64) *NServer {
+	peers := make([]*protocol.Connection, n)
+	var i = uint64(0)
+	for i < n {
+		peers[i] = &protocol.Connection{Network: "memory", Address: "server-" + strconv.FormatUint(i, 10)}
+		i++
+	}
+	s := New(id, peers[id], peers, 1000)
+	s.DataDirectory = directory
+	s.SyncPolicy = policy
+	err := recoverFromStorage(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func writeRequest(s *NServer, id uint64, key string) *Message {
+	return &Message{MessageType: 0,
+		C2S_Client_Id:            id,
+		C2S_Client_RequestId:     id,
+		C2S_Client_OperationType: 1,
+		C2S_Client_Key:           []byte(key),
+		C2S_Client_Data:          []byte("value-" + key),
+		C2S_Client_VersionVector: make([]uint64, len(s.Peers)),
+	}
+}
+
+func write(t *testing.T, s *NServer, keys ...string) {
+	for _, key := range keys {
+		err := handler(s, writeRequest(s, uint64(len(s.MyOperations))+s.MyOperationsOffset, key))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func checkSameState(t *testing.T, recovered *NServer, s *NServer) {
+	if !equalSlices(recovered.VectorClock, s.VectorClock) {
+		t.Errorf("recovered vector clock %v, want %v", recovered.VectorClock, s.VectorClock)
+	}
+	if len(recovered.KeyValueStore) != len(s.KeyValueStore) {
+		t.Errorf("recovered %d keys, want %d", len(recovered.KeyValueStore), len(s.KeyValueStore))
+	}
+	for key, operation := range s.KeyValueStore {
+		if !bytes.Equal(recovered.KeyValueStore[key].Data, operation.Data) {
+			t.Errorf("recovered %q for key %q, want %q", recovered.KeyValueStore[key].Data, key, operation.Data)
+		}
+	}
+	if recovered.MyOperationsOffset+uint64(len(recovered.MyOperations)) != recovered.VectorClock[recovered.Id] {
+		t.Errorf("recovered log ends at %d, vector clock at %d",
+			recovered.MyOperationsOffset+uint64(len(recovered.MyOperations)), recovered.VectorClock[recovered.Id])
+	}
+}
+
+func TestRecoverReplaysLog(t *testing.T) {
+	directory := t.TempDir()
+	s := newStorageServer(t, 0, 1, directory, SyncPerOperation)
+	write(t, s, "a", "b", "a", "c", "d")
+
+	recovered := newStorageServer(t, 0, 1, directory, SyncPerOperation)
+	checkSameState(t, recovered, s)
+	if recovered.VectorClock[0] != 5 {
+		t.Fatalf("recovered %d operations, want 5", recovered.VectorClock[0])
+	}
+}
+
+func TestRecoverFromSnapshotAndLog(t *testing.T) {
+	directory := t.TempDir()
+	s := newStorageServer(t, 0, 1, directory, SyncPerOperation)
+	write(t, s, "a", "b", "c")
+	err := s.storage.snapshot(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write(t, s, "b", "d")
+
+	recovered := newStorageServer(t, 0, 1, directory, SyncPerOperation)
+	checkSameState(t, recovered, s)
+
+	// Recovery writes a snapshot of its own, so recovering again starts from
+	// it and an empty log.
+	write(t, recovered, "e")
+	again := newStorageServer(t, 0, 1, directory, SyncPerOperation)
+	checkSameState(t, again, recovered)
+}
+
+func TestRecoverStopsAtTornRecord(t *testing.T) {
+	directory := t.TempDir()
+	s := newStorageServer(t, 0, 1, directory, SyncPerOperation)
+	write(t, s, "a", "b", "c")
+
+	info, err := os.Stat(s.storage.logPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Truncate(s.storage.logPath(), info.Size()-3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recovered := newStorageServer(t, 0, 1, directory, SyncPerOperation)
+	if recovered.VectorClock[0] != 2 || len(recovered.KeyValueStore) != 2 {
+		t.Fatalf("recovered %d operations and %d keys, want 2 and 2", recovered.VectorClock[0], len(recovered.KeyValueStore))
+	}
+}
+
+// A server that lost its last writes holds new ones back until a peer has
+// reported how many of its operations it has and sent back the lost one.
+func TestRecoveryWaitsForLostOperations(t *testing.T) {
+	directory := t.TempDir()
+	s := newStorageServer(t, 0, 2, directory, SyncNone)
+	// Nothing was lost before the first start.
+	s.RecoveryWaiting = nil
+	write(t, s, "a", "b")
+	lost := s.MyOperations[1]
+
+	info, err := os.Stat(s.storage.logPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Truncate(s.storage.logPath(), info.Size()-3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recovered := newStorageServer(t, 0, 2, directory, SyncNone)
+	if recovered.VectorClock[0] != 1 {
+		t.Fatalf("recovered %d operations, want 1", recovered.VectorClock[0])
+	}
+	write(t, recovered, "c")
+	if recovered.VectorClock[0] != 1 || len(recovered.UnsatisfiedRequests) != 1 {
+		t.Fatalf("took a write before hearing from its peer")
+	}
+
+	err = handler(recovered, &Message{MessageType: 2,
+		S2S_Acknowledge_Gossip_Sending_ServerId:   1,
+		S2S_Acknowledge_Gossip_Receiving_ServerId: 0,
+		S2S_Acknowledge_Gossip_Index:              2,
+		S2S_Acknowledge_Gossip_VectorClock:        []uint64{2, 0},
+		S2S_Acknowledge_Gossip_Epoch:              1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recovered.RecoveryTarget != 2 || len(recovered.UnsatisfiedRequests) != 1 {
+		t.Fatalf("took a write before getting its lost operation back")
+	}
+
+	err = handler(recovered, &Message{MessageType: 1,
+		S2S_Gossip_Sending_ServerId:    1,
+		S2S_Gossip_Receiving_ServerId:  0,
+		S2S_Gossip_Operations:          []Operation{lost},
+		S2S_Gossip_StableVersionVector: []uint64{0, 0},
+		S2S_Gossip_VectorClock:         []uint64{2, 0},
+		S2S_Gossip_Epoch:               1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recovered.UnsatisfiedRequests) != 0 || recovered.VectorClock[0] != 3 {
+		t.Fatalf("vector clock %v with %d writes held back, want [3 0] and none",
+			recovered.VectorClock, len(recovered.UnsatisfiedRequests))
+	}
+	if recovered.MyOperationsOffset+uint64(len(recovered.MyOperations)) != 3 {
+		t.Fatalf("own log ends at %d, want 3", recovered.MyOperationsOffset+uint64(len(recovered.MyOperations)))
+	}
+	if !bytes.Equal(recovered.KeyValueStore["c"].Data, []byte("value-c")) {
+		t.Fatalf("the held back write was not applied")
+	}
+}
+
+// Replaying the log puts back into MyOperations exactly the operations the
+// log recorded as the server's own.
+func TestRecoverRebuildsOwnOperations(t *testing.T) {
+	directory := t.TempDir()
+	s := newStorageServer(t, 0, 2, directory, SyncPerOperation)
+	write(t, s, "a")
+	err := handler(s, &Message{MessageType: 1,
+		S2S_Gossip_Sending_ServerId:   1,
+		S2S_Gossip_Receiving_ServerId: 0,
+		S2S_Gossip_Operations:         []Operation{{VersionVector: []uint64{0, 1}, Key: []byte("p"), Data: []byte("peer")}},
+		S2S_Gossip_VectorClock:        []uint64{0, 1},
+		S2S_Gossip_Epoch:              1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	write(t, s, "b")
+
+	recovered := newStorageServer(t, 0, 2, directory, SyncPerOperation)
+	checkSameState(t, recovered, s)
+	if len(recovered.MyOperations) != 2 || len(recovered.OperationsPerformed) != 3 {
+		t.Fatalf("recovered %d own operations of %d, want 2 of 3", len(recovered.MyOperations), len(recovered.OperationsPerformed))
+	}
+	for i, key := range []string{"a", "b"} {
+		if string(recovered.MyOperations[i].Key) != key {
+			t.Fatalf("own operation %d is for key %q, want %q", i, recovered.MyOperations[i].Key, key)
+		}
+	}
+}
+
+// A server without a data directory has no log to recover from, so it holds
+// writes back until every peer has told it how much of its log they hold.
+func TestStartWithoutLogWaitsForPeers(t *testing.T) {
+	transport := NewMemoryTransport()
+	peers := []*protocol.Connection{{Network: "memory", Address: "server-0"}, {Network: "memory", Address: "server-1"}}
+	s := New(0, peers[0], peers, 1000)
+	s.Transport = transport
+	go Start(s)
+
+	var c Conn
+	var err error
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c, err = transport.Dial(peers[0])
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	defer c.Close()
+
+	request := Message{MessageType: 0,
+		C2S_Client_Id:            1,
+		C2S_Client_RequestId:     1,
+		C2S_Client_OperationType: 1,
+		C2S_Client_Key:           []byte("k"),
+		C2S_Client_Data:          []byte("v"),
+		C2S_Client_VersionVector: []uint64{0, 0},
+	}
+	err = c.Send(&request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replies := make(chan Message, 1)
+	go func() {
+		var m Message
+		if c.Receive(&m) == nil {
+			replies <- m
+		}
+	}()
+
+	select {
+	case m := <-replies:
+		t.Fatalf("took a write before hearing from its peer: %+v", m)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	peer := New(1, peers[1], peers, 1000)
+	peer.Transport = transport
+	go Start(peer)
+
+	select {
+	case m := <-replies:
+		if m.S2C_Client_Status != StatusOk || m.S2C_Client_VersionVector[0] != 1 {
+			t.Fatalf("got reply %+v", m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the write was not served after the peer came up")
+	}
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"errors"
+	"math/rand/v2"
+	"sort"
+)
+
+// Topology decides which peers a server gossips to. Every server derives the
+// whole graph from the same configuration, so the graph is undirected and the
+// same at every server. K is the number of random peers each server adds in a
+// "random" topology, which is built on a ring so that it is connected. In a
+// "regional" topology the servers of a region form a full mesh and the first
+// server of every region links the regions; a server in no region is a region
+// of its own. Fanout is the number of neighbours picked at random on each
+// gossip tick, or zero for all of them.
+type Topology struct {
+	Type    string
+	K       uint64
+	Seed    uint64
+	Regions [][]uint64
+	Fanout  uint64
+}
+
+var ErrUnknownTopology = errors.New("unknown topology")
+
+func addEdge(edges []map[uint64]bool, i uint64, j uint64) {
+	if i == j {
+		return
+	}
+	edges[i][j] = true
+	edges[j][i] = true
+}
+
+// Neighbours returns the peers server id gossips to in a cluster of n servers,
+// in increasing order.
+func Neighbours(topology Topology, id uint64, n uint64) ([]uint64, error) {
+	edges := make([]map[uint64]bool, n)
+	var i = uint64(0)
+	for i < n {
+		edges[i] = make(map[uint64]bool)
+		i++
+	}
+
+	switch topology.Type {
+	case "", "full":
+		i = uint64(0)
+		for i < n {
+			var j = i + 1
+			for j < n {
+				addEdge(edges, i, j)
+				j++
+			}
+			i++
+		}
+	case "ring":
+		i = uint64(0)
+		for i < n {
+			addEdge(edges, i, (i+1)%n)
+			i++
+		}
+	case "tree":
+		i = uint64(1)
+		for i < n {
+			addEdge(edges, i, (i-1)/2)
+			i++
+		}
+	case "random":
+		r := rand.New(rand.NewPCG(topology.Seed, topology.Seed+1))
+		i = uint64(0)
+		for i < n {
+			addEdge(edges, i, (i+1)%n)
+			i++
+		}
+		i = uint64(0)
+		for i < n && n > 1 {
+			var k = uint64(0)
+			for k < topology.K {
+				j := r.Uint64N(n - 1)
+				if j >= i {
+					j++
+				}
+				addEdge(edges, i, j)
+				k++
+			}
+			i++
+		}
+	case "regional":
+		regions := make([][]uint64, 0)
+		seen := make(map[uint64]bool)
+		for _, region := range topology.Regions {
+			members := make([]uint64, 0)
+			for _, j := range region {
+				if j < n && !seen[j] {
+					seen[j] = true
+					members = append(members, j)
+				}
+			}
+			if len(members) != 0 {
+				regions = append(regions, members)
+			}
+		}
+		i = uint64(0)
+		for i < n {
+			if !seen[i] {
+				regions = append(regions, []uint64{i})
+			}
+			i++
+		}
+
+		for a, region := range regions {
+			for x := range region {
+				for y := x + 1; y < len(region); y++ {
+					addEdge(edges, region[x], region[y])
+				}
+			}
+			for b := a + 1; b < len(regions); b++ {
+				addEdge(edges, region[0], regions[b][0])
+			}
+		}
+	default:
+		return nil, ErrUnknownTopology
+	}
+
+	if id >= n {
+		return make([]uint64, 0), nil
+	}
+	var neighbours = make([]uint64, 0, len(edges[id]))
+	for j := range edges[id] {
+		neighbours = append(neighbours, j)
+	}
+	sort.Slice(neighbours, func(a, b int) bool { return neighbours[a] < neighbours[b] })
+	return neighbours, nil
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func allNeighbours(t *testing.T, topology Topology, n uint64) [][]uint64 {
+	neighbours := make([][]uint64, n)
+	var i = uint64(0)
+	for i < n {
+		var err error
+		neighbours[i], err = Neighbours(topology, i, n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		i++
+	}
+	return neighbours
+}
+
+// Every server must be reachable from every other, the graph must be the same
+// seen from both ends of an edge, and no server is its own neighbour.
+func checkGraph(t *testing.T, neighbours [][]uint64) {
+	for i, ns := range neighbours {
+		for _, j := range ns {
+			if j == uint64(i) {
+				t.Errorf("server %d is its own neighbour", i)
+			}
+			found := false
+			for _, k := range neighbours[j] {
+				found = found || k == uint64(i)
+			}
+			if !found {
+				t.Errorf("server %d has neighbour %d but not the other way round", i, j)
+			}
+		}
+	}
+
+	seen := make([]bool, len(neighbours))
+	queue := []uint64{0}
+	seen[0] = true
+	for len(queue) != 0 {
+		i := queue[0]
+		queue = queue[1:]
+		for _, j := range neighbours[i] {
+			if !seen[j] {
+				seen[j] = true
+				queue = append(queue, j)
+			}
+		}
+	}
+	for i := range seen {
+		if !seen[i] {
+			t.Errorf("server %d is not reachable from server 0", i)
+		}
+	}
+}
+
+func TestNeighbours(t *testing.T) {
+	tests := []struct {
+		topology   Topology
+		n          uint64
+		neighbours [][]uint64
+	}{
+		{Topology{}, 3, [][]uint64{{1, 2}, {0, 2}, {0, 1}}},
+		{Topology{Type: "full"}, 4, [][]uint64{{1, 2, 3}, {0, 2, 3}, {0, 1, 3}, {0, 1, 2}}},
+		{Topology{Type: "ring"}, 4, [][]uint64{{1, 3}, {0, 2}, {1, 3}, {0, 2}}},
+		{Topology{Type: "ring"}, 2, [][]uint64{{1}, {0}}},
+		{Topology{Type: "tree"}, 6, [][]uint64{{1, 2}, {0, 3, 4}, {0, 5}, {1}, {1}, {2}}},
+		{Topology{Type: "regional", Regions: [][]uint64{{0, 1}, {2, 3, 4}}}, 6,
+			[][]uint64{{1, 2, 5}, {0}, {0, 3, 4, 5}, {2, 4}, {2, 3}, {0, 2}}},
+		{Topology{}, 1, [][]uint64{{}}},
+	}
+	for _, test := range tests {
+		neighbours := allNeighbours(t, test.topology, test.n)
+		if !reflect.DeepEqual(neighbours, test.neighbours) {
+			t.Errorf("%q topology of %d servers: got %v, want %v", test.topology.Type, test.n, neighbours, test.neighbours)
+		}
+		checkGraph(t, neighbours)
+	}
+}
+
+func TestRandomNeighbours(t *testing.T) {
+	topology := Topology{Type: "random", K: 2, Seed: 3}
+	neighbours := allNeighbours(t, topology, 10)
+	checkGraph(t, neighbours)
+	if !reflect.DeepEqual(neighbours, allNeighbours(t, topology, 10)) {
+		t.Fatal("the same seed gave different graphs")
+	}
+	for i, ns := range neighbours {
+		if uint64(len(ns)) < topology.K {
+			t.Errorf("server %d has %d neighbours, want at least %d", i, len(ns), topology.K)
+		}
+	}
+}
+
+func TestUnknownTopology(t *testing.T) {
+	_, err := Neighbours(Topology{Type: "star"}, 0, 3)
+	if !errors.Is(err, ErrUnknownTopology) {
+		t.Fatalf("got %v, want %v", err, ErrUnknownTopology)
+	}
+}
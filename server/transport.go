@@ -0,0 +1,240 @@
+package server
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/alanwang67/session_semantics/protocol"
+)
+
+type Conn interface {
+	Send(m *Message) error
+	Receive(m *Message) error
+	Close() error
+}
+
+type Listener interface {
+	Accept() (Conn, error)
+	Close() error
+}
+
+type Transport interface {
+	Listen(c *protocol.Connection) (Listener, error)
+	Dial(c *protocol.Connection) (Conn, error)
+}
+
+type TCPTransport struct{}
+
+type tcpListener struct {
+	l net.Listener
+}
+
+type tcpConn struct {
+	c   net.Conn
+	enc *gob.Encoder
+	dec *gob.Decoder
+	mu  sync.Mutex
+}
+
+func newTCPConn(c net.Conn) *tcpConn {
+	return &tcpConn{c: c, enc: gob.NewEncoder(c), dec: gob.NewDecoder(c)}
+}
+
+func (TCPTransport) Listen(c *protocol.Connection) (Listener, error) {
+	l, err := net.Listen(c.Network, c.Address)
+	if err != nil {
+		return nil, err
+	}
+	return &tcpListener{l: l}, nil
+}
+
+func (TCPTransport) Dial(c *protocol.Connection) (Conn, error) {
+	conn, err := net.Dial(c.Network, c.Address)
+	if err != nil {
+		return nil, err
+	}
+	return newTCPConn(conn), nil
+}
+
+func (l *tcpListener) Accept() (Conn, error) {
+	c, err := l.l.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return newTCPConn(c), nil
+}
+
+func (l *tcpListener) Close() error {
+	return l.l.Close()
+}
+
+// Replies to a connection are sent from several goroutines, so encoding is
+// serialized here rather than by every caller.
+func (c *tcpConn) Send(m *Message) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.enc.Encode(m)
+}
+
+func (c *tcpConn) Receive(m *Message) error {
+	return c.dec.Decode(m)
+}
+
+func (c *tcpConn) Close() error {
+	return c.c.Close()
+}
+
+var ErrNoListener = errors.New("no listener at address")
+
+// MemoryTransport connects servers and clients in the same process over
+// channels. Messages are passed through gob on the way, so they are copied and
+// arrive exactly as they would over TCP.
+type MemoryTransport struct {
+	listeners map[string]*memoryListener
+	mu        sync.Mutex
+}
+
+type memoryListener struct {
+	t       *MemoryTransport
+	key     string
+	conns   chan Conn
+	closed  chan struct{}
+	closeMu sync.Once
+}
+
+type memoryPipe struct {
+	messages chan Message
+	closed   chan struct{}
+	once     sync.Once
+}
+
+type memoryConn struct {
+	in  *memoryPipe
+	out *memoryPipe
+	buf bytes.Buffer
+	enc *gob.Encoder
+	dec *gob.Decoder
+	mu  sync.Mutex
+}
+
+func NewMemoryTransport() *MemoryTransport {
+	return &MemoryTransport{listeners: make(map[string]*memoryListener)}
+}
+
+func memoryKey(c *protocol.Connection) string {
+	return c.Network + "/" + c.Address
+}
+
+func newMemoryPipe() *memoryPipe {
+	return &memoryPipe{messages: make(chan Message, 1024), closed: make(chan struct{})}
+}
+
+func newMemoryConn(in *memoryPipe, out *memoryPipe) *memoryConn {
+	c := &memoryConn{in: in, out: out}
+	c.enc = gob.NewEncoder(&c.buf)
+	c.dec = gob.NewDecoder(&c.buf)
+	return c
+}
+
+func (t *MemoryTransport) Listen(c *protocol.Connection) (Listener, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := memoryKey(c)
+	_, ok := t.listeners[key]
+	if ok {
+		return nil, errors.New("address already in use: " + key)
+	}
+	l := &memoryListener{t: t, key: key, conns: make(chan Conn, 64), closed: make(chan struct{})}
+	t.listeners[key] = l
+	return l, nil
+}
+
+func (t *MemoryTransport) Dial(c *protocol.Connection) (Conn, error) {
+	t.mu.Lock()
+	l, ok := t.listeners[memoryKey(c)]
+	t.mu.Unlock()
+	if !ok {
+		return nil, ErrNoListener
+	}
+
+	toListener := newMemoryPipe()
+	toDialer := newMemoryPipe()
+	select {
+	case l.conns <- newMemoryConn(toListener, toDialer):
+		return newMemoryConn(toDialer, toListener), nil
+	case <-l.closed:
+		return nil, ErrNoListener
+	}
+}
+
+func (l *memoryListener) Accept() (Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *memoryListener) Close() error {
+	l.closeMu.Do(func() {
+		l.t.mu.Lock()
+		delete(l.t.listeners, l.key)
+		l.t.mu.Unlock()
+		close(l.closed)
+	})
+	return nil
+}
+
+func (c *memoryConn) Send(m *Message) error {
+	c.mu.Lock()
+	var copied = Message{}
+	err := c.enc.Encode(m)
+	if err == nil {
+		err = c.dec.Decode(&copied)
+	}
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-c.out.closed:
+		return net.ErrClosed
+	case <-c.in.closed:
+		return net.ErrClosed
+	default:
+	}
+
+	select {
+	case c.out.messages <- copied:
+		return nil
+	case <-c.out.closed:
+		return net.ErrClosed
+	case <-c.in.closed:
+		return net.ErrClosed
+	}
+}
+
+func (c *memoryConn) Receive(m *Message) error {
+	select {
+	case copied := <-c.in.messages:
+		*m = copied
+		return nil
+	case <-c.in.closed:
+		return io.EOF
+	case <-c.out.closed:
+		return io.EOF
+	}
+}
+
+func (c *memoryConn) Close() error {
+	c.in.once.Do(func() { close(c.in.closed) })
+	c.out.once.Do(func() { close(c.out.closed) })
+	return nil
+}
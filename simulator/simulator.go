@@ -0,0 +1,387 @@
+package simulator
+
+import (
+	"container/heap"
+	"encoding/binary"
+	"math/rand/v2"
+
+	"github.com/alanwang67/session_semantics/checker"
+	"github.com/alanwang67/session_semantics/client"
+	"github.com/alanwang67/session_semantics/server"
+)
+
+// Times are in simulated microseconds. Every random choice is drawn from a
+// single generator seeded by Seed, so a run is fully determined by its Config.
+type Config struct {
+	Seed           uint64
+	Servers        uint64
+	Clients        uint64
+	Operations     uint64
+	Guarantees     client.Guarantee
+	Workload       uint64
+	Keys           uint64
+	SwitchServer   uint64
+	GossipInterval uint64
+	GossipJitter   uint64
+	MinDelay       uint64
+	MaxDelay       uint64
+	Reorder        bool
+	MaxTime        uint64
+	Trace          bool
+	History        bool
+
+	UnsatisfiedPolicy   uint64
+	AntiEntropyInterval uint64
+	Topology            server.Topology
+	GossipMinInterval   uint64
+	GossipMaxInterval   uint64
+	GossipMaxOperations uint64
+	GossipMaxBytes      uint64
+	ForwardTimeout      uint64
+}
+
+const (
+	deliverToServer = uint64(0)
+	deliverToClient = uint64(1)
+	gossipTick      = uint64(2)
+	clientIssue     = uint64(3)
+	antiEntropyTick = uint64(4)
+)
+
+type TraceEntry struct {
+	Time    uint64
+	Kind    uint64
+	Node    uint64
+	Message server.Message
+}
+
+type Result struct {
+	Seed      uint64
+	Time      uint64
+	Completed uint64
+	Failed    uint64
+	Converged bool
+	Servers   []server.Server
+	Clients   []client.Client
+	Trace     []TraceEntry
+	History   []checker.Event
+}
+
+type event struct {
+	time    uint64
+	seq     uint64
+	kind    uint64
+	node    uint64
+	message server.Message
+}
+
+type eventQueue []event
+
+func (q eventQueue) Len() int { return len(q) }
+
+func (q eventQueue) Less(i, j int) bool {
+	if q[i].time != q[j].time {
+		return q[i].time < q[j].time
+	}
+	return q[i].seq < q[j].seq
+}
+
+func (q eventQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *eventQueue) Push(x any) { *q = append(*q, x.(event)) }
+
+func (q *eventQueue) Pop() any {
+	old := *q
+	e := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return e
+}
+
+type link struct {
+	fromClient bool
+	from       uint64
+	toClient   bool
+	to         uint64
+}
+
+type simulatedClient struct {
+	state     client.Client
+	index     uint64
+	serverId  uint64
+	operation uint64
+	key       []byte
+	value     []byte
+	done      bool
+}
+
+type simulation struct {
+	config    Config
+	r         *rand.Rand
+	now       uint64
+	seq       uint64
+	queue     eventQueue
+	servers   []server.Server
+	clients   []simulatedClient
+	arrivals  map[link]uint64
+	intervals []uint64
+	result    Result
+}
+
+func (sim *simulation) schedule(time uint64, kind uint64, node uint64, message server.Message) {
+	heap.Push(&sim.queue, event{time: time, seq: sim.seq, kind: kind, node: node, message: message})
+	sim.seq += 1
+}
+
+func (sim *simulation) delay() uint64 {
+	if sim.config.MaxDelay <= sim.config.MinDelay {
+		return sim.config.MinDelay
+	}
+	return sim.config.MinDelay + sim.r.Uint64N(sim.config.MaxDelay-sim.config.MinDelay+1)
+}
+
+// Unless Reorder is set, messages on a link arrive in the order they were
+// sent, as they would over a TCP connection.
+func (sim *simulation) send(l link, message server.Message) {
+	arrival := sim.now + sim.delay()
+	if !sim.config.Reorder && sim.arrivals[l] > arrival {
+		arrival = sim.arrivals[l]
+	}
+	sim.arrivals[l] = arrival
+
+	if l.toClient {
+		sim.schedule(arrival, deliverToClient, l.to, message)
+	} else {
+		sim.schedule(arrival, deliverToServer, l.to, message)
+	}
+}
+
+func destination(message server.Message) (bool, uint64) {
+	switch message.MessageType {
+	case 1:
+		return false, message.S2S_Gossip_Receiving_ServerId
+	case 2:
+		return false, message.S2S_Acknowledge_Gossip_Receiving_ServerId
+	case 4:
+		return true, message.S2C_Client_Number
+	case 5:
+		return false, message.S2S_Snapshot_Receiving_ServerId
+	case 7, 8, 11:
+		return false, message.S2S_Forward_Receiving_ServerId
+	case 9:
+		return false, message.S2S_AntiEntropy_Receiving_ServerId
+	}
+	return false, 0
+}
+
+func (sim *simulation) runServer(id uint64, message server.Message) {
+	sim.servers[id].Now = sim.now
+	s, outGoingRequests := server.ProcessRequest(sim.servers[id], message)
+	s.Journal = s.Journal[:0]
+	s.InstalledSnapshot = false
+	sim.servers[id] = s
+
+	var i = uint64(0)
+	for i < uint64(len(outGoingRequests)) {
+		toClient, to := destination(outGoingRequests[i])
+		sim.send(link{fromClient: false, from: id, toClient: toClient, to: to}, outGoingRequests[i])
+		i++
+	}
+}
+
+func (sim *simulation) issue(id uint64) {
+	c := &sim.clients[id]
+	if c.index >= sim.config.Operations {
+		c.done = true
+		return
+	}
+
+	if sim.config.SwitchServer != 0 && c.index%sim.config.SwitchServer == 0 {
+		c.serverId = sim.r.Uint64N(sim.config.Servers)
+	}
+
+	c.operation = uint64(0)
+	if sim.r.Uint64N(100) < sim.config.Workload {
+		c.operation = uint64(1)
+	}
+
+	c.key = binary.BigEndian.AppendUint64(nil, sim.r.Uint64N(sim.config.Keys))
+	c.value = binary.BigEndian.AppendUint64(binary.BigEndian.AppendUint64(nil, id), c.index)
+
+	var message server.Message
+	c.state, message = client.ProcessRequest(c.state, c.operation, c.serverId, c.key, c.value, c.state.Guarantees, server.Message{})
+	sim.send(link{fromClient: true, from: id, toClient: false, to: c.serverId}, message)
+}
+
+func (sim *simulation) gossipTargets(id uint64) []uint64 {
+	neighbours := sim.servers[id].Neighbours
+	fanout := sim.config.Topology.Fanout
+	if fanout == 0 || fanout >= uint64(len(neighbours)) {
+		return nil
+	}
+	var targets = make([]uint64, 0, fanout)
+	for _, i := range sim.r.Perm(len(neighbours))[:fanout] {
+		targets = append(targets, neighbours[i])
+	}
+	return targets
+}
+
+func (sim *simulation) converged() bool {
+	var i = uint64(0)
+	for i < uint64(len(sim.clients)) {
+		if !sim.clients[i].done {
+			return false
+		}
+		i++
+	}
+
+	i = uint64(1)
+	for i < uint64(len(sim.servers)) {
+		var j = uint64(0)
+		for j < uint64(len(sim.servers[i].VectorClock)) {
+			if sim.servers[i].VectorClock[j] != sim.servers[0].VectorClock[j] {
+				return false
+			}
+			j++
+		}
+		i++
+	}
+	return true
+}
+
+func Run(config Config) Result {
+	sim := &simulation{
+		config:    config,
+		r:         rand.New(rand.NewPCG(config.Seed, config.Seed^0x9e3779b97f4a7c15)),
+		queue:     make(eventQueue, 0),
+		servers:   make([]server.Server, config.Servers),
+		clients:   make([]simulatedClient, config.Clients),
+		arrivals:  make(map[link]uint64),
+		intervals: make([]uint64, config.Servers),
+		result:    Result{Seed: config.Seed},
+	}
+	if sim.config.Keys == 0 {
+		sim.config.Keys = 1
+	}
+	if sim.config.GossipInterval == 0 {
+		sim.config.GossipInterval = 1000
+	}
+	config = sim.config
+
+	var i = uint64(0)
+	for i < config.Servers {
+		sim.servers[i] = server.NewState(i, config.Servers)
+		sim.servers[i].UnsatisfiedPolicy = config.UnsatisfiedPolicy
+		if config.Topology.Type != "" && config.Topology.Type != "full" {
+			sim.servers[i].Neighbours, _ = server.Neighbours(config.Topology, i, config.Servers)
+			sim.servers[i].Relay = true
+		}
+		if config.GossipMaxOperations != 0 {
+			sim.servers[i].GossipMaxOperations = config.GossipMaxOperations
+		}
+		if config.GossipMaxBytes != 0 {
+			sim.servers[i].GossipMaxBytes = config.GossipMaxBytes
+		}
+		if config.ForwardTimeout != 0 {
+			sim.servers[i].ForwardTimeout = config.ForwardTimeout
+		}
+		sim.intervals[i] = config.GossipInterval
+		sim.schedule(sim.r.Uint64N(config.GossipInterval+1), gossipTick, i, server.Message{})
+		if config.AntiEntropyInterval != 0 && config.Servers > 1 {
+			sim.schedule(sim.r.Uint64N(config.AntiEntropyInterval+1), antiEntropyTick, i, server.Message{})
+		}
+		i++
+	}
+
+	i = uint64(0)
+	for i < config.Clients {
+		sim.clients[i] = simulatedClient{
+			state: client.Client{
+				Id:                 i,
+				NumberOfServers:    config.Servers,
+				WriteVersionVector: make([]uint64, config.Servers),
+				ReadVersionVector:  make([]uint64, config.Servers),
+				Guarantees:         config.Guarantees,
+			},
+			serverId: i % config.Servers,
+		}
+		sim.schedule(0, clientIssue, i, server.Message{})
+		i++
+	}
+
+	for sim.queue.Len() > 0 {
+		e := heap.Pop(&sim.queue).(event)
+		if config.MaxTime != 0 && e.time > config.MaxTime {
+			break
+		}
+		sim.now = e.time
+
+		if config.Trace && e.kind != gossipTick && e.kind != clientIssue && e.kind != antiEntropyTick {
+			sim.result.Trace = append(sim.result.Trace, TraceEntry{Time: e.time, Kind: e.kind, Node: e.node, Message: e.message})
+		}
+
+		switch e.kind {
+		case deliverToServer:
+			sim.runServer(e.node, e.message)
+		case gossipTick:
+			sim.runServer(e.node, server.Message{MessageType: 3, S2S_Gossip_Targets: sim.gossipTargets(e.node)})
+			sim.intervals[e.node] = server.NextGossipInterval(sim.intervals[e.node], config.GossipMinInterval, config.GossipMaxInterval,
+				sim.servers[e.node].GossipSentOperations)
+			jitter := uint64(0)
+			if config.GossipJitter != 0 {
+				jitter = sim.r.Uint64N(config.GossipJitter)
+			}
+			sim.schedule(sim.now+sim.intervals[e.node]+jitter, gossipTick, e.node, server.Message{})
+		case deliverToClient:
+			c := &sim.clients[e.node]
+			c.state, _ = client.ProcessRequest(c.state, 2, 0, nil, nil, c.state.Guarantees, e.message)
+			if config.History && e.message.S2C_Client_Status == server.StatusOk {
+				value := c.value
+				if c.operation == uint64(0) {
+					value = e.message.S2C_Client_Data
+				}
+				sim.result.History = append(sim.result.History, checker.Event{
+					Client:        e.node,
+					Index:         c.index,
+					OperationType: c.operation,
+					Key:           c.key,
+					Value:         value,
+					VersionVector: e.message.S2C_Client_VersionVector,
+					Server:        e.message.S2C_Server_Id,
+					Guarantees:    c.state.Guarantees.CheckerGuarantees(),
+				})
+			}
+			c.index += 1
+			if e.message.S2C_Client_Status == server.StatusOk {
+				sim.result.Completed += 1
+			} else {
+				sim.result.Failed += 1
+			}
+			sim.schedule(sim.now, clientIssue, e.node, server.Message{})
+		case clientIssue:
+			sim.issue(e.node)
+		case antiEntropyTick:
+			peer := sim.r.Uint64N(config.Servers - 1)
+			if peer >= e.node {
+				peer++
+			}
+			sim.runServer(e.node, server.Message{MessageType: 10, S2S_AntiEntropy_Receiving_ServerId: peer})
+			sim.schedule(sim.now+config.AntiEntropyInterval, antiEntropyTick, e.node, server.Message{})
+		}
+
+		if sim.converged() {
+			sim.result.Converged = true
+			break
+		}
+	}
+
+	sim.result.Time = sim.now
+	sim.result.Servers = sim.servers
+	sim.result.Clients = make([]client.Client, len(sim.clients))
+	i = uint64(0)
+	for i < uint64(len(sim.clients)) {
+		sim.result.Clients[i] = sim.clients[i].state
+		i++
+	}
+
+	return sim.result
+}
@@ -0,0 +1,82 @@
+package simulator
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/alanwang67/session_semantics/checker"
+	"github.com/alanwang67/session_semantics/client"
+	"github.com/alanwang67/session_semantics/server"
+)
+
+func testConfig(seed uint64) Config {
+	return Config{
+		Seed:                seed,
+		Servers:             3,
+		Clients:             4,
+		Operations:          100,
+		Guarantees:          client.Causal,
+		Workload:            50,
+		Keys:                10,
+		SwitchServer:        10,
+		GossipInterval:      1000,
+		GossipJitter:        500,
+		MinDelay:            50,
+		MaxDelay:            2000,
+		Reorder:             true,
+		MaxTime:             600000000,
+		Trace:               true,
+		History:             true,
+		AntiEntropyInterval: 5000,
+		Topology:            server.Topology{Type: "ring"},
+	}
+}
+
+func TestRunIsDeterministic(t *testing.T) {
+	r1 := Run(testConfig(7))
+	r2 := Run(testConfig(7))
+
+	if r1.Time != r2.Time || r1.Completed != r2.Completed || r1.Converged != r2.Converged {
+		t.Fatalf("runs with the same seed differ: %d operations by %d and %d by %d", r1.Completed, r1.Time, r2.Completed, r2.Time)
+	}
+	if !reflect.DeepEqual(r1.History, r2.History) {
+		t.Fatal("runs with the same seed recorded different histories")
+	}
+	if !reflect.DeepEqual(r1.Trace, r2.Trace) {
+		t.Fatal("runs with the same seed delivered different messages")
+	}
+
+	r3 := Run(testConfig(8))
+	if reflect.DeepEqual(r1.Trace, r3.Trace) {
+		t.Fatal("runs with different seeds delivered the same messages")
+	}
+}
+
+func TestRunConvergesWithoutViolations(t *testing.T) {
+	r := Run(testConfig(1))
+	if !r.Converged {
+		t.Fatal("servers did not converge")
+	}
+	if r.Completed != 4*100 {
+		t.Fatalf("completed %d operations, want %d", r.Completed, 4*100)
+	}
+	for _, v := range checker.Check(r.History) {
+		t.Error(v)
+	}
+}
+
+// Requests that a server rejects count as failed, not completed.
+func TestRunCountsRejectedRequestsAsFailed(t *testing.T) {
+	config := testConfig(1)
+	config.UnsatisfiedPolicy = server.UnsatisfiedReject
+	r := Run(config)
+	if r.Failed == 0 {
+		t.Fatal("no request was rejected")
+	}
+	if r.Completed+r.Failed != 4*100 {
+		t.Fatalf("completed %d and failed %d operations, want %d in all", r.Completed, r.Failed, 4*100)
+	}
+	if uint64(len(r.History)) != r.Completed {
+		t.Fatalf("recorded %d events for %d completed operations", len(r.History), r.Completed)
+	}
+}